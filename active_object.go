@@ -2,15 +2,117 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 	log "github.com/Sirupsen/logrus"
 )
 
+var ErrStopped = errors.New("ActiveObject is stopped")
+var ErrAlreadyStarted = errors.New("ActiveObject is already started")
+var ErrQueueFull = errors.New("ActiveObject queue is full")
+var ErrDropped = errors.New("ActiveObject command is dropped")
+
+// ErrDestroyed is the former name of ErrStopped, it is the same error.
+//
+// Deprecated: Use ErrStopped.
+var ErrDestroyed = ErrStopped
+
+// PanicError is returned by the *Ctx methods when a command panics
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+var _ error = &PanicError{}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("ActiveObject command panic: %v", err.Value)
+}
+
+// StopPolicy defines what Stop does with commands which are still queued
+type StopPolicy int
+const (
+	StopPolicy_Drain StopPolicy = iota // Execute all queued commands before exit
+	StopPolicy_Reject                  // Drop queued commands, their sync callers get ErrStopped
+)
+
+// OverflowPolicy defines what happens to a new command when the queue is full
+type OverflowPolicy int
+const (
+	OverflowPolicy_Block        OverflowPolicy = iota // Wait for a free slot
+	OverflowPolicy_BlockTimeout                       // Wait for a free slot, but not longer than the block timeout, then ErrQueueFull
+	OverflowPolicy_Reject                             // Fail with ErrQueueFull
+	OverflowPolicy_DropNewest                         // Drop the new command, ErrDropped is returned to the caller
+	OverflowPolicy_DropOldest                         // Drop the oldest queued command, its sync caller gets ErrDropped
+)
+
+type command struct {
+	f          func()
+	onReject   func(err error)       // Optional, called instead of f when the command is dropped
+	onPanic    func(err *PanicError) // Optional, handles a panic of f instead of the supervisor
+	target     interface{}           // The user function f wraps, for logging
+	enqueuedAt time.Time
+	ctx        context.Context // Values of the sender context, restored while f executes
+	queueSpan  Span
+	internal   bool // Bookkeeping of the object itself, not counted as executed
+}
+
+func (cmd *command) reject(err error) {
+	if cmd.queueSpan != nil {
+		cmd.queueSpan.End()
+	}
+	if cmd.onReject != nil {
+		cmd.onReject(err)
+	}
+}
+
 type ActiveObject struct {
-	chStopWork       chan interface{}
-	cmdCh            chan func()
+	chStopping       chan struct{}
+	chDone           chan struct{}
+	cmdCh            chan command
 	messageProcessor func() bool
+	idleStrategy     IdleStrategy
+	wakeCh           chan struct{}
+
+	mutex      sync.Mutex
+	state      ActiveObjectState
+	stopPolicy StopPolicy
+	senders    sync.WaitGroup
+
+	overflowPolicy OverflowPolicy
+	blockTimeout   time.Duration
+
+	supervisor *Supervisor
+
+	goroutineId       uint64
+	busy              int32 // Set while user code runs on the object goroutine
+	reentrancyMode    ReentrancyMode
+	watchdogThreshold time.Duration
+
+	metrics       *activeObjectMetrics
+	slowThreshold int64 // time.Duration
+
+	clock     Clock
+	scheduler scheduler
+
+	batch *BatchConfig
+
+	tracer     Tracer
+	currentCtx context.Context // Accessed only on the object goroutine
+
+	manual     bool
+	stepMutex  sync.Mutex
+	manualStop sync.Once
+
+	initOnce    sync.Once
+	cmdPoolSize int
+	onStart     []func()
+	onStop      []func()
 }
 
 func (this *ActiveObject) Create(messageProcessor func() bool) {
@@ -22,81 +124,499 @@ func (this *ActiveObject) Create1(cmdPoolSize int) {
 }
 
 func (this *ActiveObject) Create2(messageProcessor func() bool, cmdPoolSize int) {
-	this.chStopWork = make(chan interface{})
-	this.cmdCh = make(chan func(), cmdPoolSize)
+	this.Create3(messageProcessor, nil, cmdPoolSize)
+}
+
+// Create3 is Create2 with an explicit idle strategy for messageProcessor, nil means DefaultIdleStrategy.
+// The Create methods may be called again after Destroy, settings made by the setters are kept.
+func (this *ActiveObject) Create3(messageProcessor func() bool, idleStrategy IdleStrategy, cmdPoolSize int) {
+	this.prepareCreate()
 	this.messageProcessor = messageProcessor
-	go this.run()
+	this.idleStrategy = idleStrategy
+	this.cmdPoolSize = cmdPoolSize
+	this.ensureInit()
+	if err := this.Start(); err != nil {
+		log.Errorf("ActiveObject.Create failed to start, reason %v", err)
+	}
+}
+
+// prepareCreate makes ensureInit run again with the settings of a Create method, as it may have already run,
+// e.g. by Stats or Destroy
+func (this *ActiveObject) prepareCreate() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state == ActiveObjectState_Running || this.state == ActiveObjectState_Stopping {
+		panic(errors.New("ActiveObject must be destroyed before it is created again"))
+	}
+	this.state = ActiveObjectState_New
+	this.initOnce = sync.Once{}
+	this.manualStop = sync.Once{}
+}
+
+// ensureInit makes the zero value usable, settings made before the first call are taken into account
+func (this *ActiveObject) ensureInit() {
+	this.initOnce.Do(func() {
+		if this.clock == nil {
+			this.clock = SystemClock
+		}
+		this.chStopping = make(chan struct{})
+		this.chDone = make(chan struct{})
+		this.cmdCh = make(chan command, this.cmdPoolSize)
+		this.wakeCh = make(chan struct{}, 1)
+		this.metrics = newActiveObjectMetrics()
+	})
+}
+
+// Wakeup tells an idle message processing loop that messageProcessor has work to do. Safe to call from any goroutine.
+func (this *ActiveObject) Wakeup() {
+	this.ensureInit()
+	select {
+	case this.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// SetClock sets the clock used by ExecuteAfter, ExecuteEvery and ExecuteCron. Must be called before Create.
+func (this *ActiveObject) SetClock(clock Clock) {
+	this.clock = clock
+}
+
+func (this *ActiveObject) SetStopPolicy(policy StopPolicy) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stopPolicy = policy
+}
+
+// SetOverflowPolicy sets the full queue policy, blockTimeout has sense only for OverflowPolicy_BlockTimeout.
+// OverflowPolicy_DropOldest behaves as OverflowPolicy_DropNewest when cmdPoolSize is 0.
+func (this *ActiveObject) SetOverflowPolicy(policy OverflowPolicy, blockTimeout time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.overflowPolicy = policy
+	this.blockTimeout = blockTimeout
+}
+
+// ExecuteAsync returns ErrStopped if the object is stopping or stopped
+func (this *ActiveObject) ExecuteAsync(f func()) error {
+	return this.ExecuteAsyncCtx(context.Background(), f)
+}
+
+// ExecuteSync returns ErrStopped if the object is stopping or stopped, panic of f is re-panicked in the caller
+func (this *ActiveObject) ExecuteSync(f func()) error {
+	if inline, err := this.checkReentrancy(); inline {
+		f()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer this.startSyncWatchdog()()
+
+	var panicValue interface{}
+	waitCh := make(chan error, 1)
+	err := this.enqueue(context.Background(), command{
+		f: func() {
+			defer func() {
+				panicValue = recover()
+				if panicValue != nil {
+					stack := string(debug.Stack()[:])
+					log.Errorf("ActiveObject.ExecuteSync(%T) panic:\n%v\n%v\n", f, panicValue, stack)
+				}
+				waitCh <- nil
+			}()
+			f()
+		},
+		onReject: func(err error) {
+			waitCh <- err
+		},
+		target: f,
+	})
+	if err != nil {
+		return err
+	}
+	this.stepManualUntil(func() bool { return len(waitCh) > 0 })
+	err = <-waitCh
+	if panicValue != nil {
+		panic(panicValue)
+	}
+	return err
+}
+
+// ExecuteAsyncWithPanicHandler is ExecuteAsync where a panic of f is passed to onPanic on the object
+// goroutine. Such a panic is reported to the supervisor OnPanic hook, but does not count as a failure.
+func (this *ActiveObject) ExecuteAsyncWithPanicHandler(f func(), onPanic func(err *PanicError)) error {
+	return this.enqueue(context.Background(), command{f: f, onPanic: onPanic})
+}
+
+// TryExecuteAsync never blocks, it returns false if the command is not accepted
+// because the object is stopped or its queue is full (see SetOverflowPolicy)
+func (this *ActiveObject) TryExecuteAsync(f func()) bool {
+	return this.enqueueExt(context.Background(), command{f: f}, false) == nil
+}
+
+// ExecuteAsyncCtx enqueues f, giving up with ctx.Err() or ErrStopped if the queue does not accept it in time
+func (this *ActiveObject) ExecuteAsyncCtx(ctx context.Context, f func()) error {
+	return this.enqueue(ctx, command{f: f})
+}
+
+func (this *ActiveObject) enqueue(ctx context.Context, cmd command) error {
+	return this.enqueueExt(ctx, cmd, true)
+}
+
+func (this *ActiveObject) enqueueExt(ctx context.Context, cmd command, mayBlock bool) error {
+	this.ensureInit()
+	cmd.enqueuedAt = time.Now()
+	cmd.ctx = ctx
+	tracer := this.getTracer()
+	if tracer != nil {
+		_, cmd.queueSpan = tracer.StartSpan(ctx, "ActiveObject.queue")
+	}
+	err := this.send(ctx, cmd, mayBlock)
+	if err == nil {
+		this.metrics.observeQueueDepth(len(this.cmdCh))
+	} else if cmd.queueSpan != nil {
+		cmd.queueSpan.End()
+	}
+	return err
+}
+
+func (this *ActiveObject) send(ctx context.Context, cmd command, mayBlock bool) error {
+	this.mutex.Lock()
+	if this.state >= ActiveObjectState_Stopping {
+		this.mutex.Unlock()
+		return ErrStopped
+	}
+	this.senders.Add(1)
+	policy, blockTimeout := this.overflowPolicy, this.blockTimeout
+	this.mutex.Unlock()
+	defer this.senders.Done()
+
+	select {
+	case this.cmdCh <- cmd:
+		return nil
+	default:
+	}
+
+	switch {
+	case policy == OverflowPolicy_DropOldest && cap(this.cmdCh) > 0:
+		return this.enqueueDroppingOldest(cmd)
+	case policy == OverflowPolicy_DropOldest || policy == OverflowPolicy_DropNewest:
+		return ErrDropped
+	case policy == OverflowPolicy_Reject || !mayBlock:
+		return ErrQueueFull
+	}
+
+	var timeoutCh <-chan time.Time
+	if policy == OverflowPolicy_BlockTimeout {
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case this.cmdCh <- cmd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-this.chStopping:
+		return ErrStopped
+	case <-timeoutCh:
+		return ErrQueueFull
+	}
+}
+
+func (this *ActiveObject) enqueueDroppingOldest(cmd command) error {
+	for {
+		select {
+		case this.cmdCh <- cmd:
+			return nil
+		default:
+		}
+		select {
+		case oldest := <-this.cmdCh:
+			oldest.reject(ErrDropped)
+		default:
+		}
+	}
 }
 
-func (this *ActiveObject) ExecuteAsync(f func()) {
-	this.cmdCh <- f
+// ExecuteSyncCtx runs f on the object goroutine and waits for it. A panic in f is returned as *PanicError.
+// When ctx is done before f completes, ctx.Err() is returned; f is skipped if it has not started yet.
+func (this *ActiveObject) ExecuteSyncCtx(ctx context.Context, f func()) error {
+	return this.submitSync(ctx, f)()
 }
 
-func (this *ActiveObject) ExecuteSync(f func()) {
-	waitCh := make(chan interface{})
-	this.ExecuteAsync(func() {
-		defer func() {
-			err := recover()
-			if err != nil {
-				stack := string(debug.Stack()[:])
-				log.Errorf("ActiveObject.ExecuteSync(%T) panic:\n%v\n%v\n", f, err, stack)
+// submitSync enqueues f for ExecuteSyncCtx and returns the function which waits for it
+func (this *ActiveObject) submitSync(ctx context.Context, f func()) (wait func() error) {
+	if inline, err := this.checkReentrancy(); inline {
+		return func() error { return callWithRecover(f) }
+	} else if err != nil {
+		return func() error { return err }
+	}
+	stopWatchdog := this.startSyncWatchdog()
+
+	waitCh := make(chan error, 1)
+	err := this.enqueue(ctx, command{
+		f: func() {
+			if ctx.Err() != nil {
+				waitCh <- ctx.Err()
+				return
 			}
+			waitCh <- callWithRecover(f)
+		},
+		onReject: func(err error) {
 			waitCh <- err
-		}()
-		f()
+		},
+		target: f,
 	})
-	err := <-waitCh
 	if err != nil {
-		panic(err)
+		stopWatchdog()
+		return func() error { return err }
+	}
+	return func() error {
+		defer stopWatchdog()
+		this.stepManualUntil(func() bool { return len(waitCh) > 0 || ctx.Err() != nil })
+		select {
+		case err := <-waitCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
+func callWithRecover(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: string(debug.Stack()[:])}
+		}
+	}()
+	f()
+	return nil
+}
+
 func (this *ActiveObject) defaultMsgProcess() {
 	for {
 		select {
-		case <-this.chStopWork:
+		case <-this.chStopping:
 			return
 		case cmd := <-this.cmdCh:
-			cmd()
+			this.handleCmd(cmd)
+		case <-this.scheduler.timerCh(this.clock):
+			this.runDueScheduled()
 		}
 	}
 }
 
+// withHandlerMsgProcess gives commands priority over messageProcessor. When messageProcessor reports
+// that it has nothing to do, the loop waits as long as idleStrategy says, or until Wakeup or a command.
+// In batch mode messageProcessor runs between batches.
 func (this *ActiveObject) withHandlerMsgProcess() {
+	idleRounds := 0
 	for {
 		select {
-		case <-this.chStopWork:
+		case <-this.chStopping:
 			return
 		case cmd := <-this.cmdCh:
-			cmd()
+			this.dispatchCmd(cmd)
+			continue
+		case <-this.scheduler.timerCh(this.clock):
+			this.runDueScheduled()
+			continue
 		default:
-			if !this.messageProcessor() {
-				time.Sleep(1)
+		}
+
+		atomic.StoreInt32(&this.busy, 1)
+		hasWork := this.messageProcessor()
+		atomic.StoreInt32(&this.busy, 0)
+		if hasWork {
+			idleRounds = 0
+			continue
+		}
+		idleRounds++
+
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if d := this.idleStrategy.IdleDuration(idleRounds); d >= 0 {
+			timer = time.NewTimer(d)
+			timerCh = timer.C
+		}
+		select {
+		case <-this.chStopping:
+		case cmd := <-this.cmdCh:
+			this.dispatchCmd(cmd)
+			idleRounds = 0
+		case <-this.wakeCh:
+			idleRounds = 0
+		case <-this.scheduler.timerCh(this.clock):
+			this.runDueScheduled()
+			idleRounds = 0
+		case <-timerCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (this *ActiveObject) handleCmd(cmd command) {
+	select {
+	case <-this.chStopping:
+		this.mutex.Lock()
+		policy := this.stopPolicy
+		this.mutex.Unlock()
+		if policy == StopPolicy_Reject {
+			cmd.reject(ErrStopped)
+			return
+		}
+	default:
+	}
+	started := time.Now()
+	if !cmd.enqueuedAt.IsZero() {
+		this.metrics.queueWait.ObserveDuration(started.Sub(cmd.enqueuedAt))
+	}
+	if cmd.queueSpan != nil {
+		cmd.queueSpan.End()
+	}
+	ctx := cmd.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var execSpan Span
+	if tracer := this.getTracer(); tracer != nil {
+		ctx, execSpan = tracer.StartSpan(ctx, "ActiveObject.execute")
+	}
+	prevCtx := this.currentCtx
+	this.currentCtx = context.WithoutCancel(ctx)
+	err := this.callUserCode(cmd.f)
+	this.currentCtx = prevCtx
+	if execSpan != nil {
+		execSpan.End()
+	}
+	elapsed := time.Since(started)
+	this.metrics.executionTime.ObserveDuration(elapsed)
+	if !cmd.internal {
+		atomic.AddUint64(&this.metrics.executed, 1)
+	}
+	if threshold := time.Duration(atomic.LoadInt64(&this.slowThreshold)); threshold > 0 && elapsed > threshold {
+		target := cmd.target
+		if target == nil {
+			target = cmd.f
+		}
+		log.Warnf("ActiveObject slow command %T %s took %v", target, funcName(target), elapsed)
+	}
+	if err != nil {
+		this.handlePanic(err.(*PanicError), cmd.onPanic)
+	}
+}
+
+// handlePanic is called on the object goroutine. Without a supervisor an unhandled panic is fatal, as it always was.
+func (this *ActiveObject) handlePanic(err *PanicError, handler func(err *PanicError)) {
+	atomic.AddUint64(&this.metrics.panics, 1)
+	this.mutex.Lock()
+	supervisor := this.supervisor
+	this.mutex.Unlock()
+
+	if supervisor != nil {
+		supervisor.notifyPanic(this, err)
+	}
+	if handler != nil {
+		handler(err)
+		return
+	}
+	if supervisor == nil {
+		log.Fatalf("ActiveObject.run panicing:%v\n%v\n", err.Value, err.Stack)
+	}
+	if supervisor.handleFailure(this) == SupervisorDirective_Restart {
+		log.Errorf("ActiveObject restarted after panic:%v\n%v\n", err.Value, err.Stack)
+	} else {
+		log.Errorf("ActiveObject stopped by supervisor after panic:%v\n%v\n", err.Value, err.Stack)
+		this.requestStop()
+	}
+}
+
+// drainQueue is called after chStopping is closed. Once all in-flight senders have returned nothing
+// can be added to cmdCh anymore, so whatever is left there is the final backlog.
+func (this *ActiveObject) drainQueue() {
+	this.senders.Wait()
+	for {
+		select {
+		case cmd := <-this.cmdCh:
+			if this.batch != nil {
+				this.runBatch(cmd, false)
+			} else {
+				this.handleCmd(cmd)
 			}
+		default:
+			return
 		}
 	}
 }
 
 func (this *ActiveObject) run() {
+	chDone := this.chDone // The object may be created again as soon as it is stopped
+	defer close(chDone)
+	atomic.StoreUint64(&this.goroutineId, currentGoroutineId())
+	this.callHooks(this.onStart)
+	for !this.runLoop() {
+	}
+	this.scheduler.clear()
+	this.drainQueue()
+	this.callHooks(this.onStop)
+	this.setState(ActiveObjectState_Stopped)
+}
+
+// runLoop returns false when the loop was broken by a panic outside of a command (e.g. in messageProcessor)
+// and the supervisor decided to restart it
+func (this *ActiveObject) runLoop() (exited bool) {
 	defer func() {
-		err := recover()
-		if nil != err {
-			log.Fatalf("ActiveObject.run panicing:%v\n%v\n", err, string(debug.Stack()[:]))
+		if err := recover(); err != nil {
+			atomic.StoreInt32(&this.busy, 0)
+			this.handlePanic(&PanicError{Value: err, Stack: string(debug.Stack()[:])}, nil)
 		}
 	}()
 
-	if this.messageProcessor == nil {
-		this.defaultMsgProcess()
-	} else {
+	if this.messageProcessor != nil {
 		this.withHandlerMsgProcess()
+	} else if this.batch != nil {
+		this.batchMsgProcess()
+	} else {
+		this.defaultMsgProcess()
 	}
+	return true
 }
 
-func (this *ActiveObject) Destroy() {
-	if nil != this.chStopWork {
-		this.chStopWork <- nil
-		close(this.chStopWork)
+// requestStop does not wait for the goroutine exit, so it can be called from the object goroutine
+func (this *ActiveObject) requestStop() {
+	this.ensureInit()
+	this.mutex.Lock()
+	notStarted := this.state == ActiveObjectState_New
+	if notStarted || this.state == ActiveObjectState_Running {
+		this.state = ActiveObjectState_Stopping
+		close(this.chStopping)
 	}
-	this.chStopWork = nil
-	close(this.cmdCh)
+	this.mutex.Unlock()
+	if notStarted {
+		this.stopNotStarted()
+	}
+}
+
+// Stop stops accepting new commands, handles queued ones according to the stop policy and
+// waits until the object goroutine exits. Returns ctx.Err() if ctx is done before that.
+// Stop is idempotent. Commands queued to a never started object are rejected.
+// Must not be called from the object goroutine itself.
+func (this *ActiveObject) Stop(ctx context.Context) error {
+	this.requestStop()
+	if this.manual {
+		this.stopManual()
+	}
+
+	select {
+	case <-this.chDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *ActiveObject) Destroy() {
+	this.Stop(context.Background())
 }
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"time"
+)
+
+// BatchConfig turns ActiveObject into batch-draining mode: after the first command arrives the loop keeps
+// taking queued commands until MaxSize of them are executed or Linger passes, with hooks around the batch.
+// E.g. a DB writer can commit once per batch in AfterBatch instead of once per command.
+// With a messageProcessor (see WithMessageProcessor) it runs between batches.
+type BatchConfig struct {
+	MaxSize     int            // Commands per batch limit, 0 means no limit
+	Linger      time.Duration  // How long to wait for more commands, 0 means take only the already queued ones
+	BeforeBatch func()         // Optional, called before the first command of a batch
+	AfterBatch  func(size int) // Optional, called after the last command of a batch
+}
+
+// CreateBatch is Create1 in batch-draining mode. Commands left in the queue on stop
+// are drained in batches too (without lingering), so AfterBatch is called for them.
+func (this *ActiveObject) CreateBatch(config BatchConfig, cmdPoolSize int) {
+	this.batch = &config
+	this.Create2(nil, cmdPoolSize)
+}
+
+func (this *ActiveObject) batchMsgProcess() {
+	for {
+		select {
+		case <-this.chStopping:
+			return
+		case cmd := <-this.cmdCh:
+			this.runBatch(cmd, true)
+		case <-this.scheduler.timerCh(this.clock):
+			this.runDueScheduled()
+		}
+	}
+}
+
+// dispatchCmd runs cmd alone or, in batch mode, as the first command of a batch
+func (this *ActiveObject) dispatchCmd(cmd command) {
+	if this.batch != nil {
+		this.runBatch(cmd, true)
+	} else {
+		this.handleCmd(cmd)
+	}
+}
+
+func (this *ActiveObject) runBatch(first command, linger bool) {
+	this.callBatchHook(func() {
+		if this.batch.BeforeBatch != nil {
+			this.batch.BeforeBatch()
+		}
+	})
+	this.handleCmd(first)
+	size := 1
+
+	var lingerCh <-chan time.Time
+	if linger && this.batch.Linger > 0 {
+		timer := this.clock.NewTimer(this.batch.Linger)
+		defer timer.Stop()
+		lingerCh = timer.C()
+	}
+loop:
+	for this.batch.MaxSize <= 0 || size < this.batch.MaxSize {
+		if lingerCh == nil {
+			select {
+			case cmd := <-this.cmdCh:
+				this.handleCmd(cmd)
+				size++
+				continue
+			default:
+				break loop
+			}
+		}
+		select {
+		case cmd := <-this.cmdCh:
+			this.handleCmd(cmd)
+			size++
+		case <-lingerCh:
+			break loop
+		case <-this.chStopping:
+			lingerCh = nil // Take what is already queued and finish the batch
+		}
+	}
+
+	this.callBatchHook(func() {
+		if this.batch.AfterBatch != nil {
+			this.batch.AfterBatch(size)
+		}
+	})
+}
+
+func (this *ActiveObject) callBatchHook(hook func()) {
+	if err := this.callUserCode(hook); err != nil {
+		this.handlePanic(err.(*PanicError), nil)
+	}
+}
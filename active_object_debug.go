@@ -0,0 +1,101 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrReentrantCall = errors.New("ActiveObject sync call is made from the object goroutine itself, " +
+	"it would wait for its own completion forever. Use ExecuteAsync there or ReentrancyMode_Inline")
+
+// ReentrancyMode defines what ExecuteSync and ExecuteSyncCtx do when called from the object goroutine
+type ReentrancyMode int
+const (
+	ReentrancyMode_Fail   ReentrancyMode = iota // Return ErrReentrantCall
+	ReentrancyMode_Inline                       // Run the function right away, skipping the queue
+)
+
+func (this *ActiveObject) SetReentrancyMode(mode ReentrancyMode) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.reentrancyMode = mode
+}
+
+// SetSyncWatchdog is a debug option, when threshold > 0 all goroutine stacks are logged
+// if a sync call waits longer than threshold
+func (this *ActiveObject) SetSyncWatchdog(threshold time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.watchdogThreshold = threshold
+}
+
+// checkReentrancy returns inline=true if the caller should run the function itself.
+// The goroutine id is costly to get, so it is compared only while user code runs on the object goroutine.
+func (this *ActiveObject) checkReentrancy() (inline bool, err error) {
+	if atomic.LoadInt32(&this.busy) == 0 {
+		return false, nil
+	}
+	id := atomic.LoadUint64(&this.goroutineId)
+	if id == 0 || id != currentGoroutineId() {
+		return false, nil
+	}
+	this.mutex.Lock()
+	mode := this.reentrancyMode
+	this.mutex.Unlock()
+	if mode == ReentrancyMode_Inline {
+		return true, nil
+	}
+	return false, ErrReentrantCall
+}
+
+// callUserCode runs f on the object goroutine, marking it busy for checkReentrancy
+func (this *ActiveObject) callUserCode(f func()) error {
+	atomic.StoreInt32(&this.busy, 1)
+	defer atomic.StoreInt32(&this.busy, 0)
+	return callWithRecover(f)
+}
+
+// startSyncWatchdog returns a function which disarms the watchdog
+func (this *ActiveObject) startSyncWatchdog() func() {
+	this.mutex.Lock()
+	threshold := this.watchdogThreshold
+	this.mutex.Unlock()
+	if threshold <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(threshold, func() {
+		log.Warnf("ActiveObject sync call is waiting longer than %v, all goroutines:\n%s", threshold, allGoroutineStacks())
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+// currentGoroutineId parses the id from the "goroutine 123 [running]:" header of the current stack
+func currentGoroutineId() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	buf = buf[:bytes.IndexByte(buf, ' ')]
+	id, err := strconv.ParseUint(string(buf), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func allGoroutineStacks() string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
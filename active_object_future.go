@@ -0,0 +1,131 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// Future is a result of a command submitted to ActiveObject with Submit
+type Future[T any] struct {
+	ao        *ActiveObject
+	done      chan struct{}
+	mutex     sync.Mutex
+	completed bool
+	value     T
+	err       error
+	callbacks []func(onActor bool)
+}
+
+func newFuture[T any](ao *ActiveObject) *Future[T] {
+	return &Future[T]{ao: ao, done: make(chan struct{})}
+}
+
+// Submit enqueues f to ao. A panic in f completes the future with *PanicError,
+// a command rejected by the object completes it with the rejection error.
+func Submit[T any](ao *ActiveObject, f func() (T, error)) *Future[T] {
+	future := newFuture[T](ao)
+	err := ao.enqueue(context.Background(), command{
+		f: func() {
+			value, err := callWithRecoverT(f)
+			future.complete(value, err, true)
+		},
+		onReject: func(err error) {
+			var zero T
+			future.complete(zero, err, true)
+		},
+		target: f,
+	})
+	if err != nil {
+		var zero T
+		future.complete(zero, err, false)
+	}
+	return future
+}
+
+func callWithRecoverT[T any](f func() (T, error)) (value T, err error) {
+	panicErr := callWithRecover(func() {
+		value, err = f()
+	})
+	if panicErr != nil {
+		var zero T
+		return zero, panicErr
+	}
+	return
+}
+
+func (this *Future[T]) complete(value T, err error, onActor bool) {
+	this.mutex.Lock()
+	if this.completed {
+		this.mutex.Unlock()
+		return
+	}
+	this.completed = true
+	this.value, this.err = value, err
+	callbacks := this.callbacks
+	this.callbacks = nil
+	close(this.done)
+	this.mutex.Unlock()
+
+	for _, callback := range callbacks {
+		callback(onActor)
+	}
+}
+
+// onComplete calls callback right away if the future is completed, otherwise on completion.
+// onActor tells whether callback is called on the object goroutine.
+func (this *Future[T]) onComplete(callback func(onActor bool)) {
+	this.mutex.Lock()
+	if !this.completed {
+		this.callbacks = append(this.callbacks, callback)
+		this.mutex.Unlock()
+		return
+	}
+	this.mutex.Unlock()
+	callback(false)
+}
+
+// Done returns a channel which is closed when the future is completed
+func (this *Future[T]) Done() <-chan struct{} {
+	return this.done
+}
+
+// Await waits for the future result, returns ctx.Err() if ctx is done first
+func (this *Future[T]) Await(ctx context.Context) (T, error) {
+	select {
+	case <-this.done:
+		return this.value, this.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Then runs f with the result of future on the same ActiveObject. If future completes with an
+// error, f is not called and the error is passed to the returned future.
+func Then[T any, R any](future *Future[T], f func(T) (R, error)) *Future[R] {
+	result := newFuture[R](future.ao)
+	future.onComplete(func(onActor bool) {
+		if future.err != nil {
+			var zero R
+			result.complete(zero, future.err, onActor)
+			return
+		}
+		if onActor {
+			value, err := callWithRecoverT(func() (R, error) { return f(future.value) })
+			result.complete(value, err, true)
+			return
+		}
+		next := Submit(future.ao, func() (R, error) { return f(future.value) })
+		next.onComplete(func(onActor bool) {
+			result.complete(next.value, next.err, onActor)
+		})
+	})
+	return result
+}
+
+// Map is Then for functions which cannot fail
+func Map[T any, R any](future *Future[T], f func(T) R) *Future[R] {
+	return Then(future, func(value T) (R, error) {
+		return f(value), nil
+	})
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitThenMap(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+
+	counter := 0
+	first := Submit(&ao, func() (int, error) {
+		counter++
+		return counter, nil
+	})
+	second := Then(first, func(v int) (int, error) {
+		counter++
+		return v + counter, nil
+	})
+	third := Map(second, func(v int) string { return strconv.Itoa(v) })
+
+	value, err := third.Await(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "3", value)
+	<-first.Done()
+
+	// Continuation of an already completed future is submitted to the object again
+	fourth := Map(first, func(v int) int { return v * 10 })
+	value4, err := fourth.Await(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 10, value4)
+}
+
+func TestFutureErrors(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+
+	expectedErr := errors.New("failed")
+	called := false
+	failed := Then(Submit(&ao, func() (int, error) { return 0, expectedErr }), func(v int) (int, error) {
+		called = true
+		return v, nil
+	})
+	_, err := failed.Await(context.Background())
+	assert.Equal(t, expectedErr, err)
+	assert.False(t, called)
+
+	_, err = Submit(&ao, func() (int, error) { panic("boom") }).Await(context.Background())
+	assert.IsType(t, &PanicError{}, err)
+
+	ao.Destroy()
+	_, err = Submit(&ao, func() (int, error) { return 1, nil }).Await(context.Background())
+	assert.Equal(t, ErrStopped, err)
+}
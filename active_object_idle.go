@@ -0,0 +1,67 @@
+package util
+
+import (
+	"time"
+)
+
+// IdleStrategy decides how long ActiveObject waits after its messageProcessor returned false
+type IdleStrategy interface {
+	// IdleDuration is called with the number of consecutive idle messageProcessor calls (starting from 1).
+	// Negative result means wait until a command arrives or Wakeup is called.
+	IdleDuration(idleRounds int) time.Duration
+}
+
+// DefaultIdleStrategy is used when no strategy is given, it suits processors which never call Wakeup
+var DefaultIdleStrategy IdleStrategy = BackoffIdleStrategy{Min: MinIdleDuration, Max: 10 * time.Millisecond}
+
+// MinIdleDuration is the shortest wait of the polling strategies, so that a zero setting does not busy-spin
+const MinIdleDuration = 50 * time.Microsecond
+
+// NotifyIdleStrategy blocks until a command or Wakeup, the processor must call Wakeup when it gets work
+type NotifyIdleStrategy struct{}
+
+var _ IdleStrategy = NotifyIdleStrategy{}
+
+func (this NotifyIdleStrategy) IdleDuration(idleRounds int) time.Duration {
+	return -1
+}
+
+// BackoffIdleStrategy doubles the wait from Min up to Max with every consecutive idle round.
+// Min and Max below MinIdleDuration are raised to it.
+type BackoffIdleStrategy struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+var _ IdleStrategy = BackoffIdleStrategy{}
+
+func (this BackoffIdleStrategy) IdleDuration(idleRounds int) time.Duration {
+	d, max := this.Min, this.Max
+	if d < MinIdleDuration {
+		d = MinIdleDuration
+	}
+	if max < MinIdleDuration {
+		max = MinIdleDuration
+	}
+	for i := 1; i < idleRounds && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// TickIdleStrategy polls the processor every Interval while idle, an Interval below MinIdleDuration is raised to it
+type TickIdleStrategy struct {
+	Interval time.Duration
+}
+
+var _ IdleStrategy = TickIdleStrategy{}
+
+func (this TickIdleStrategy) IdleDuration(idleRounds int) time.Duration {
+	if this.Interval < MinIdleDuration {
+		return MinIdleDuration
+	}
+	return this.Interval
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"time"
+)
+
+type ActiveObjectState int
+const (
+	ActiveObjectState_New      ActiveObjectState = iota // Created, commands are queued but not executed
+	ActiveObjectState_Running                           // The object goroutine executes commands
+	ActiveObjectState_Stopping                          // New commands are rejected, queued ones are being drained
+	ActiveObjectState_Stopped                           // The object goroutine has exited
+)
+
+func (this ActiveObjectState) String() string {
+	switch this {
+	case ActiveObjectState_New:
+		return "New"
+	case ActiveObjectState_Running:
+		return "Running"
+	case ActiveObjectState_Stopping:
+		return "Stopping"
+	case ActiveObjectState_Stopped:
+		return "Stopped"
+	}
+	return "Unknown"
+}
+
+type ActiveObjectOption func(ao *ActiveObject)
+
+// NewActiveObject creates a not yet started object, call Start to run it
+func NewActiveObject(options ...ActiveObjectOption) *ActiveObject {
+	result := &ActiveObject{}
+	for _, option := range options {
+		option(result)
+	}
+	result.ensureInit()
+	return result
+}
+
+func WithCmdPoolSize(cmdPoolSize int) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.cmdPoolSize = cmdPoolSize
+	}
+}
+
+// WithMessageProcessor is the Create3 message processor mode, idleStrategy may be nil
+func WithMessageProcessor(messageProcessor func() bool, idleStrategy IdleStrategy) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.messageProcessor = messageProcessor
+		ao.idleStrategy = idleStrategy
+	}
+}
+
+func WithBatch(config BatchConfig) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.batch = &config
+	}
+}
+
+func WithStopPolicy(policy StopPolicy) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetStopPolicy(policy)
+	}
+}
+
+func WithOverflowPolicy(policy OverflowPolicy, blockTimeout time.Duration) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetOverflowPolicy(policy, blockTimeout)
+	}
+}
+
+func WithSupervisor(supervisor *Supervisor) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		supervisor.Supervise(ao)
+	}
+}
+
+func WithClock(clock Clock) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetClock(clock)
+	}
+}
+
+func WithReentrancyMode(mode ReentrancyMode) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetReentrancyMode(mode)
+	}
+}
+
+func WithSyncWatchdog(threshold time.Duration) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetSyncWatchdog(threshold)
+	}
+}
+
+func WithSlowCommandThreshold(threshold time.Duration) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetSlowCommandThreshold(threshold)
+	}
+}
+
+func WithTracer(tracer Tracer) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.SetTracer(tracer)
+	}
+}
+
+// WithOnStart adds a hook which runs on the object goroutine before any command
+func WithOnStart(hook func()) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.onStart = append(ao.onStart, hook)
+	}
+}
+
+// WithOnStop adds a hook which runs on the object goroutine after the queue is drained
+func WithOnStop(hook func()) ActiveObjectOption {
+	return func(ao *ActiveObject) {
+		ao.onStop = append(ao.onStop, hook)
+	}
+}
+
+// Start launches the object goroutine. Returns ErrAlreadyStarted or ErrStopped if the object is not New.
+func (this *ActiveObject) Start() error {
+	this.ensureInit()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	switch this.state {
+	case ActiveObjectState_New:
+	case ActiveObjectState_Running:
+		return ErrAlreadyStarted
+	default:
+		return ErrStopped
+	}
+	if this.idleStrategy == nil {
+		this.idleStrategy = DefaultIdleStrategy
+	}
+	this.state = ActiveObjectState_Running
+	go this.run()
+	return nil
+}
+
+func (this *ActiveObject) State() ActiveObjectState {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.state
+}
+
+func (this *ActiveObject) setState(state ActiveObjectState) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.state = state
+}
+
+func (this *ActiveObject) callHooks(hooks []func()) {
+	for _, hook := range hooks {
+		if err := this.callUserCode(hook); err != nil {
+			this.handlePanic(err.(*PanicError), nil)
+		}
+	}
+}
+
+// stopNotStarted finishes Stop of an object whose goroutine has never run
+func (this *ActiveObject) stopNotStarted() {
+	this.senders.Wait()
+	for len(this.cmdCh) > 0 {
+		cmd := <-this.cmdCh
+		cmd.reject(ErrStopped)
+	}
+	this.setState(ActiveObjectState_Stopped)
+	close(this.chDone)
+}
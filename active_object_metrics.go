@@ -0,0 +1,200 @@
+package util
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type activeObjectMetrics struct {
+	queueHighWater int64
+	executed       uint64
+	panics         uint64
+	queueWait      *Histogram
+	executionTime  *Histogram
+}
+
+func newActiveObjectMetrics() *activeObjectMetrics {
+	return &activeObjectMetrics{
+		queueWait:     NewHistogram(DefaultLatencyBuckets),
+		executionTime: NewHistogram(DefaultLatencyBuckets),
+	}
+}
+
+func (this *activeObjectMetrics) observeQueueDepth(depth int) {
+	for {
+		highWater := atomic.LoadInt64(&this.queueHighWater)
+		if int64(depth) <= highWater || atomic.CompareAndSwapInt64(&this.queueHighWater, highWater, int64(depth)) {
+			return
+		}
+	}
+}
+
+type ActiveObjectStats struct {
+	QueueDepth     int
+	QueueCapacity  int
+	QueueHighWater int
+	Executed       uint64
+	Panics         uint64
+	QueueWait      HistogramSnapshot // Seconds
+	ExecutionTime  HistogramSnapshot // Seconds
+}
+
+func (this *ActiveObject) Stats() ActiveObjectStats {
+	this.ensureInit()
+	return ActiveObjectStats{
+		QueueDepth:     len(this.cmdCh),
+		QueueCapacity:  cap(this.cmdCh),
+		QueueHighWater: int(atomic.LoadInt64(&this.metrics.queueHighWater)),
+		Executed:       atomic.LoadUint64(&this.metrics.executed),
+		Panics:         atomic.LoadUint64(&this.metrics.panics),
+		QueueWait:      this.metrics.queueWait.Snapshot(),
+		ExecutionTime:  this.metrics.executionTime.Snapshot(),
+	}
+}
+
+// SetSlowCommandThreshold makes commands running longer than threshold be logged, 0 disables the log
+func (this *ActiveObject) SetSlowCommandThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&this.slowThreshold, int64(threshold))
+}
+
+func funcName(f interface{}) string {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+	if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
+// ActiveObjectRegistry is a named set of ActiveObjects whose stats can be exported
+type ActiveObjectRegistry struct {
+	mutex   sync.Mutex
+	objects map[string]*ActiveObject
+}
+
+var DefaultActiveObjectRegistry = NewActiveObjectRegistry()
+
+func NewActiveObjectRegistry() *ActiveObjectRegistry {
+	return &ActiveObjectRegistry{objects: map[string]*ActiveObject{}}
+}
+
+func (this *ActiveObjectRegistry) Register(name string, ao *ActiveObject) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.objects[name] = ao
+}
+
+func (this *ActiveObjectRegistry) Unregister(name string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.objects, name)
+}
+
+func (this *ActiveObjectRegistry) Snapshot() map[string]ActiveObjectStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	result := make(map[string]ActiveObjectStats, len(this.objects))
+	for name, ao := range this.objects {
+		result[name] = ao.Stats()
+	}
+	return result
+}
+
+// PublishExpvar exposes the registry snapshot as an expvar variable, it panics if name is already published
+func (this *ActiveObjectRegistry) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return this.Snapshot()
+	}))
+}
+
+// WritePrometheus writes stats of all registered objects in Prometheus text exposition format
+func (this *ActiveObjectRegistry) WritePrometheus(w io.Writer) error {
+	snapshot := this.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pw := &prometheusWriter{w: w}
+	pw.header("activeobject_queue_depth", "gauge", "Number of commands waiting in the queue")
+	for _, name := range names {
+		pw.sample("activeobject_queue_depth", name, "", float64(snapshot[name].QueueDepth))
+	}
+	pw.header("activeobject_queue_high_water", "gauge", "Maximal observed number of commands in the queue")
+	for _, name := range names {
+		pw.sample("activeobject_queue_high_water", name, "", float64(snapshot[name].QueueHighWater))
+	}
+	pw.header("activeobject_commands_executed_total", "counter", "Number of executed commands")
+	for _, name := range names {
+		pw.sample("activeobject_commands_executed_total", name, "", float64(snapshot[name].Executed))
+	}
+	pw.header("activeobject_panics_total", "counter", "Number of panics on the object goroutine")
+	for _, name := range names {
+		pw.sample("activeobject_panics_total", name, "", float64(snapshot[name].Panics))
+	}
+	pw.header("activeobject_queue_wait_seconds", "histogram", "Time commands spend in the queue")
+	for _, name := range names {
+		pw.histogram("activeobject_queue_wait_seconds", name, snapshot[name].QueueWait)
+	}
+	pw.header("activeobject_execution_seconds", "histogram", "Command execution time")
+	for _, name := range names {
+		pw.histogram("activeobject_execution_seconds", name, snapshot[name].ExecutionTime)
+	}
+	return pw.err
+}
+
+// PrometheusHandler serves WritePrometheus output, e.g. on /metrics
+func (this *ActiveObjectRegistry) PrometheusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		this.WritePrometheus(w)
+	}
+}
+
+type prometheusWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (this *prometheusWriter) printf(format string, a ...interface{}) {
+	if this.err == nil {
+		_, this.err = fmt.Fprintf(this.w, format, a...)
+	}
+}
+
+func (this *prometheusWriter) header(metric string, metricType string, help string) {
+	this.printf("# HELP %s %s\n# TYPE %s %s\n", metric, help, metric, metricType)
+}
+
+func (this *prometheusWriter) sample(metric string, name string, extraLabels string, value float64) {
+	this.printf("%s{name=%s%s} %s\n", metric, strconv.Quote(name), extraLabels, formatPrometheusFloat(value))
+}
+
+func (this *prometheusWriter) histogram(metric string, name string, h HistogramSnapshot) {
+	for _, b := range h.Buckets {
+		le := ",le=" + strconv.Quote(formatPrometheusFloat(b.UpperBound))
+		this.sample(metric+"_bucket", name, le, float64(b.Count))
+	}
+	this.sample(metric+"_sum", name, "", h.Sum)
+	this.sample(metric+"_count", name, "", float64(h.Count))
+}
+
+func formatPrometheusFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
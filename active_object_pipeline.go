@@ -0,0 +1,303 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	log "github.com/Sirupsen/logrus"
+)
+
+const DefaultPipelineBufferSize = 64
+
+// PipelineStageFunc processes one item and passes any number of results to emit. If it returns
+// an error or panics, the error is passed to the pipeline error handler and the item produces no results.
+type PipelineStageFunc func(item interface{}, emit func(result interface{})) error
+
+type PipelineStageConfig struct {
+	Workers    int  // Number of ActiveObjects processing items in parallel, 1 by default
+	Ordered    bool // With several workers, emit results in the order the items came in
+	BufferSize int  // Queue capacity of each worker, upstream blocks when it is full. DefaultPipelineBufferSize by default
+}
+
+// Pipeline is a DAG of stages, each stage runs on its own ActiveObjects. Results of a stage are sent to every
+// connected downstream stage (fan-out), a stage with several upstream stages gets all their results (fan-in).
+// Items passed to Send go to every stage without upstream. Bounded worker queues make a slow stage
+// block its upstream and finally Send.
+type Pipeline struct {
+	mutex   sync.Mutex
+	stages  map[string]*pipelineStage
+	names   []string
+	sorted  []*pipelineStage
+	sources []*pipelineStage
+	built   bool
+	stopped bool
+	onError func(stage string, item interface{}, err error)
+}
+
+type pipelineStage struct {
+	pipeline   *Pipeline
+	name       string
+	f          PipelineStageFunc
+	config     PipelineStageConfig
+	downstream []*pipelineStage
+	upstream   int
+	workers    []*ActiveObject
+	seq        uint64
+	// Ordered stage only, the collector state is accessed on the collector goroutine
+	collector  *ActiveObject
+	pending    map[uint64][]interface{}
+	nextToEmit uint64
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		stages: map[string]*pipelineStage{},
+		onError: func(stage string, item interface{}, err error) {
+			log.Errorf("Pipeline stage %s failed on item %v, reason %v", stage, item, err)
+		},
+	}
+}
+
+func (this *Pipeline) AddStage(name string, f PipelineStageFunc, config PipelineStageConfig) *Pipeline {
+	if this.built {
+		panic(errors.New("Pipeline is already built"))
+	}
+	if _, ok := this.stages[name]; ok {
+		panic(errors.New(fmt.Sprintf("Pipeline stage %s is already declared", name)))
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultPipelineBufferSize
+	}
+	this.stages[name] = &pipelineStage{pipeline: this, name: name, f: f, config: config}
+	this.names = append(this.names, name)
+	return this
+}
+
+// Connect sends results of the stage from to each of the stages to
+func (this *Pipeline) Connect(from string, to ...string) *Pipeline {
+	if this.built {
+		panic(errors.New("Pipeline is already built"))
+	}
+	source := this.stage(from)
+	for _, name := range to {
+		target := this.stage(name)
+		source.downstream = append(source.downstream, target)
+		target.upstream++
+	}
+	return this
+}
+
+func (this *Pipeline) stage(name string) *pipelineStage {
+	stage, ok := this.stages[name]
+	if !ok {
+		panic(errors.New(fmt.Sprintf("Pipeline stage %s is not declared", name)))
+	}
+	return stage
+}
+
+// SetErrorHandler replaces the handler of failed items, which logs them by default.
+// It is called on the stage goroutine.
+func (this *Pipeline) SetErrorHandler(onError func(stage string, item interface{}, err error)) {
+	this.onError = onError
+}
+
+// Build checks that the stages form a DAG and starts them
+func (this *Pipeline) Build() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.built {
+		return errors.New("Pipeline is already built")
+	}
+	if len(this.stages) == 0 {
+		return errors.New("Pipeline has no stages")
+	}
+	sorted, err := this.sortStages()
+	if err != nil {
+		return err
+	}
+	this.sorted = sorted
+	for _, stage := range sorted {
+		if stage.upstream == 0 {
+			this.sources = append(this.sources, stage)
+		}
+		stage.start()
+	}
+	this.built = true
+	return nil
+}
+
+// sortStages orders the stages so that each stage goes after all its upstream stages
+func (this *Pipeline) sortStages() ([]*pipelineStage, error) {
+	inDegree := map[*pipelineStage]int{}
+	var ready []*pipelineStage
+	for _, name := range this.names {
+		stage := this.stages[name]
+		inDegree[stage] = stage.upstream
+		if stage.upstream == 0 {
+			ready = append(ready, stage)
+		}
+	}
+	var result []*pipelineStage
+	for len(ready) > 0 {
+		stage := ready[0]
+		ready = ready[1:]
+		result = append(result, stage)
+		for _, next := range stage.downstream {
+			inDegree[next]--
+			if inDegree[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if len(result) < len(this.stages) {
+		var cycle []string
+		for _, name := range this.names {
+			if inDegree[this.stages[name]] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("Pipeline stages form a cycle: %s", strings.Join(cycle, ", ")))
+	}
+	return result, nil
+}
+
+// Send passes item to every stage without upstream, blocking while their queues are full
+func (this *Pipeline) Send(ctx context.Context, item interface{}) error {
+	this.mutex.Lock()
+	built, stopped := this.built, this.stopped
+	this.mutex.Unlock()
+	if !built {
+		return errors.New("Pipeline is not built")
+	}
+	if stopped {
+		return ErrStopped
+	}
+	for _, stage := range this.sources {
+		if err := stage.submit(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops the stages in the DAG order. Every stage drains its queues into the downstream
+// stages, which are still running, so all items sent before Stop are fully processed.
+func (this *Pipeline) Stop(ctx context.Context) error {
+	this.mutex.Lock()
+	if !this.built || this.stopped {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.stopped = true
+	this.mutex.Unlock()
+	for _, stage := range this.sorted {
+		if err := stage.stop(ctx); err != nil {
+			return errors.New(fmt.Sprintf("Pipeline stage %s did not stop, reason %v", stage.name, err))
+		}
+	}
+	return nil
+}
+
+func (this *Pipeline) Destroy() {
+	this.Stop(context.Background())
+}
+
+func (this *pipelineStage) ordered() bool {
+	return this.config.Ordered && this.config.Workers > 1
+}
+
+func (this *pipelineStage) start() {
+	for i := 0; i < this.config.Workers; i++ {
+		worker := NewActiveObject(WithCmdPoolSize(this.config.BufferSize), WithOverflowPolicy(OverflowPolicy_Block, 0))
+		worker.Start()
+		this.workers = append(this.workers, worker)
+	}
+	if this.ordered() {
+		// Never more results are pending than items queued on workers, so the collector never blocks them
+		this.pending = map[uint64][]interface{}{}
+		this.collector = NewActiveObject(WithCmdPoolSize(this.config.Workers * (this.config.BufferSize + 1)))
+		this.collector.Start()
+	}
+}
+
+// submit dispatches items to the workers round robin
+func (this *pipelineStage) submit(ctx context.Context, item interface{}) error {
+	seq := atomic.AddUint64(&this.seq, 1) - 1
+	worker := this.workers[seq%uint64(len(this.workers))]
+	err := worker.ExecuteAsyncCtx(ctx, func() {
+		this.process(worker, seq, item)
+	})
+	if err != nil && this.ordered() {
+		// The seq is taken, the collector must not wait for it
+		this.collector.ExecuteAsyncCtx(context.WithoutCancel(ctx), func() {
+			this.collect(seq, nil)
+		})
+	}
+	return err
+}
+
+func (this *pipelineStage) process(worker *ActiveObject, seq uint64, item interface{}) {
+	var results []interface{}
+	emit := func(result interface{}) {
+		this.forward(worker.Context(), result)
+	}
+	if this.ordered() {
+		emit = func(result interface{}) {
+			results = append(results, result)
+		}
+	}
+	var err error
+	if panicErr := callWithRecover(func() { err = this.f(item, emit) }); panicErr != nil {
+		err = panicErr
+	}
+	if err != nil {
+		this.pipeline.onError(this.name, item, err)
+	}
+	if this.ordered() {
+		this.collector.ExecuteAsyncCtx(worker.Context(), func() {
+			this.collect(seq, results)
+		})
+	}
+}
+
+// collect is called on the collector goroutine, it forwards results as soon as all preceding items are done
+func (this *pipelineStage) collect(seq uint64, results []interface{}) {
+	this.pending[seq] = results
+	for {
+		results, ok := this.pending[this.nextToEmit]
+		if !ok {
+			return
+		}
+		delete(this.pending, this.nextToEmit)
+		this.nextToEmit++
+		for _, result := range results {
+			this.forward(this.collector.Context(), result)
+		}
+	}
+}
+
+func (this *pipelineStage) forward(ctx context.Context, result interface{}) {
+	for _, next := range this.downstream {
+		if err := next.submit(ctx, result); err != nil {
+			this.pipeline.onError(next.name, result, err)
+		}
+	}
+}
+
+func (this *pipelineStage) stop(ctx context.Context) error {
+	for _, worker := range this.workers {
+		if err := worker.Stop(ctx); err != nil {
+			return err
+		}
+	}
+	if this.collector != nil {
+		return this.collector.Stop(ctx)
+	}
+	return nil
+}
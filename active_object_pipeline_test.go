@@ -0,0 +1,150 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+type pipelineSink struct {
+	mutex sync.Mutex
+	items []interface{}
+}
+
+func (this *pipelineSink) stage(item interface{}, emit func(interface{})) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.items = append(this.items, item)
+	return nil
+}
+
+func TestPipelineOrderedParallelStage(t *testing.T) {
+	sink := &pipelineSink{}
+	var failed []interface{}
+	pipeline := NewPipeline().
+		AddStage("square", func(item interface{}, emit func(interface{})) error {
+			n := item.(int)
+			if n == 7 {
+				return errors.New("unlucky")
+			}
+			time.Sleep(time.Duration(100-n) * 20 * time.Microsecond)
+			emit(n * n)
+			return nil
+		}, PipelineStageConfig{Workers: 4, Ordered: true, BufferSize: 2}).
+		AddStage("sink", sink.stage, PipelineStageConfig{}).
+		Connect("square", "sink")
+	pipeline.SetErrorHandler(func(stage string, item interface{}, err error) {
+		failed = append(failed, item)
+	})
+	assert.NoError(t, pipeline.Build())
+	var expected []interface{}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, pipeline.Send(context.Background(), i))
+		if i != 7 {
+			expected = append(expected, i*i)
+		}
+	}
+	assert.NoError(t, pipeline.Stop(context.Background()))
+	assert.Equal(t, expected, sink.items)
+	assert.Equal(t, []interface{}{7}, failed)
+	assert.Equal(t, ErrStopped, pipeline.Send(context.Background(), 1))
+}
+
+func TestPipelineFanOutFanIn(t *testing.T) {
+	sink := &pipelineSink{}
+	double := func(item interface{}, emit func(interface{})) error {
+		emit(item.(int) * 2)
+		return nil
+	}
+	negate := func(item interface{}, emit func(interface{})) error {
+		emit(-item.(int))
+		return nil
+	}
+	pipeline := NewPipeline().
+		AddStage("source", func(item interface{}, emit func(interface{})) error {
+			emit(item)
+			return nil
+		}, PipelineStageConfig{}).
+		AddStage("double", double, PipelineStageConfig{Workers: 2}).
+		AddStage("negate", negate, PipelineStageConfig{}).
+		AddStage("sink", sink.stage, PipelineStageConfig{}).
+		Connect("source", "double", "negate").
+		Connect("double", "sink").
+		Connect("negate", "sink")
+	assert.NoError(t, pipeline.Build())
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, pipeline.Send(context.Background(), i))
+	}
+	pipeline.Destroy()
+	var result []int
+	for _, item := range sink.items {
+		result = append(result, item.(int))
+	}
+	sort.Ints(result)
+	assert.Equal(t, []int{-3, -2, -1, 2, 4, 6}, result)
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	pipeline := NewPipeline().
+		AddStage("slow", func(item interface{}, emit func(interface{})) error {
+			<-release
+			return nil
+		}, PipelineStageConfig{BufferSize: 1})
+	assert.NoError(t, pipeline.Build())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = pipeline.Send(ctx, i)
+	}
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(release)
+	assert.NoError(t, pipeline.Stop(context.Background()))
+}
+
+func TestPipelineOrderedStageAfterFailedSend(t *testing.T) {
+	sink := &pipelineSink{}
+	release := make(chan struct{})
+	pipeline := NewPipeline().
+		AddStage("slow", func(item interface{}, emit func(interface{})) error {
+			if item.(int) == 0 {
+				<-release
+			}
+			emit(item)
+			return nil
+		}, PipelineStageConfig{Workers: 2, Ordered: true, BufferSize: 1}).
+		AddStage("sink", sink.stage, PipelineStageConfig{}).
+		Connect("slow", "sink")
+	assert.NoError(t, pipeline.Build())
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, pipeline.Send(context.Background(), i))
+	}
+	// Item 4 goes to the worker blocked by item 0, whose queue is full with item 2
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pipeline.Send(ctx, 4))
+	close(release)
+	assert.NoError(t, pipeline.Send(context.Background(), 5))
+	assert.NoError(t, pipeline.Send(context.Background(), 6))
+	assert.NoError(t, pipeline.Stop(context.Background()))
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 5, 6}, sink.items)
+}
+
+func TestPipelineBuildRejectsCycle(t *testing.T) {
+	noop := func(item interface{}, emit func(interface{})) error { return nil }
+	pipeline := NewPipeline().
+		AddStage("a", noop, PipelineStageConfig{}).
+		AddStage("b", noop, PipelineStageConfig{}).
+		AddStage("c", noop, PipelineStageConfig{}).
+		Connect("a", "b").
+		Connect("b", "c").
+		Connect("c", "b")
+	err := pipeline.Build()
+	assert.EqualError(t, err, "Pipeline stages form a cycle: b, c")
+	assert.Panics(t, func() { pipeline.Connect("a", "missing") })
+}
@@ -0,0 +1,210 @@
+package util
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduledCommand is a handle of a command scheduled with ExecuteAfter, ExecuteEvery or ExecuteCron
+type ScheduledCommand struct {
+	scheduler *scheduler
+	f         func()
+	at        time.Time
+	next      func(prev time.Time) time.Time // Nil for one-shot commands, zero result ends the schedule
+	state     int32
+}
+
+const (
+	scheduledPending int32 = iota
+	scheduledCancelled
+	scheduledFinished
+)
+
+// Cancel prevents all further executions of the command. Safe to call from any goroutine, more than once.
+// Cancel never takes a queue slot, the command is removed from the scheduler when it is due
+// or when cancelled commands make up half of the scheduler.
+func (this *ScheduledCommand) Cancel() {
+	if atomic.CompareAndSwapInt32(&this.state, scheduledPending, scheduledCancelled) && this.scheduler != nil {
+		atomic.AddInt32(&this.scheduler.cancelled, 1)
+	}
+}
+
+func (this *ScheduledCommand) isCancelled() bool {
+	return atomic.LoadInt32(&this.state) == scheduledCancelled
+}
+
+// scheduler is a min-heap of scheduled commands ordered by time with a single timer for the earliest one.
+// It is accessed only from the object goroutine, except cancelled.
+type scheduler struct {
+	queue     scheduledQueue
+	timer     ClockTimer
+	timerAt   time.Time
+	cancelled int32 // Number of cancelled commands which are still pushed or about to be pushed
+}
+
+type scheduledQueue []*ScheduledCommand
+
+func (this scheduledQueue) Len() int { return len(this) }
+
+func (this scheduledQueue) Less(i, j int) bool { return this[i].at.Before(this[j].at) }
+
+func (this scheduledQueue) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+
+func (this *scheduledQueue) Push(x interface{}) {
+	*this = append(*this, x.(*ScheduledCommand))
+}
+
+func (this *scheduledQueue) Pop() interface{} {
+	old := *this
+	n := len(old)
+	cmd := old[n-1]
+	old[n-1] = nil
+	*this = old[:n-1]
+	return cmd
+}
+
+func (this *scheduler) push(cmd *ScheduledCommand) {
+	if cmd.isCancelled() {
+		atomic.AddInt32(&this.cancelled, -1)
+		return
+	}
+	heap.Push(&this.queue, cmd)
+	this.compact()
+}
+
+// compact removes cancelled commands when they make up half of the queue, so that cancelled long schedules
+// do not pile up until they are due
+func (this *scheduler) compact() {
+	if n := int(atomic.LoadInt32(&this.cancelled)); n == 0 || n*2 < len(this.queue) {
+		return
+	}
+	queue := this.queue[:0]
+	for _, cmd := range this.queue {
+		if !cmd.isCancelled() {
+			queue = append(queue, cmd)
+		}
+	}
+	removed := len(this.queue) - len(queue)
+	for i := len(queue); i < len(this.queue); i++ {
+		this.queue[i] = nil
+	}
+	this.queue = queue
+	heap.Init(&this.queue)
+	atomic.AddInt32(&this.cancelled, int32(-removed))
+}
+
+// timerCh returns a channel which fires when the earliest command is due, nil if nothing is scheduled
+func (this *scheduler) timerCh(clock Clock) <-chan time.Time {
+	if len(this.queue) == 0 {
+		this.stopTimer()
+		return nil
+	}
+	at := this.queue[0].at
+	if this.timer == nil || !at.Equal(this.timerAt) {
+		this.stopTimer()
+		this.timer = clock.NewTimer(at.Sub(clock.Now()))
+		this.timerAt = at
+	}
+	return this.timer.C()
+}
+
+func (this *scheduler) stopTimer() {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+}
+
+// popDue removes and returns all commands which are due at now, periodic ones are pushed back with the next time
+func (this *scheduler) popDue(now time.Time) []*ScheduledCommand {
+	this.stopTimer()
+	var result []*ScheduledCommand
+	for len(this.queue) > 0 && !this.queue[0].at.After(now) {
+		cmd := heap.Pop(&this.queue).(*ScheduledCommand)
+		if cmd.isCancelled() {
+			atomic.AddInt32(&this.cancelled, -1)
+			continue
+		}
+		result = append(result, cmd)
+		var next time.Time
+		if cmd.next != nil {
+			next = cmd.next(cmd.at)
+		}
+		if next.IsZero() {
+			// Cancel of a finished command must not be counted, it is not in the queue anymore
+			atomic.CompareAndSwapInt32(&cmd.state, scheduledPending, scheduledFinished)
+			continue
+		}
+		if !next.After(now) {
+			next = cmd.next(now) // Do not try to catch up with missed runs
+		}
+		if !next.After(now) {
+			next = now.Add(time.Nanosecond) // Otherwise this loop would never end
+		}
+		cmd.at = next
+		heap.Push(&this.queue, cmd)
+	}
+	this.compact()
+	return result
+}
+
+func (this *scheduler) clear() {
+	this.stopTimer()
+	for _, cmd := range this.queue {
+		atomic.CompareAndSwapInt32(&cmd.state, scheduledPending, scheduledFinished)
+	}
+	this.queue = nil
+	atomic.StoreInt32(&this.cancelled, 0)
+}
+
+func (this *ActiveObject) runDueScheduled() {
+	for _, cmd := range this.scheduler.popDue(this.clock.Now()) {
+		if !cmd.isCancelled() {
+			this.handleCmd(command{f: cmd.f, target: cmd.f})
+		}
+	}
+}
+
+func (this *ActiveObject) schedule(at time.Time, next func(prev time.Time) time.Time, f func()) (*ScheduledCommand, error) {
+	cmd := &ScheduledCommand{scheduler: &this.scheduler, f: f, at: at, next: next}
+	err := this.enqueue(context.Background(), command{f: func() {
+		this.scheduler.push(cmd)
+	}, internal: true})
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// ExecuteAfter runs f on the object goroutine once, after d
+func (this *ActiveObject) ExecuteAfter(d time.Duration, f func()) (*ScheduledCommand, error) {
+	this.ensureInit()
+	return this.schedule(this.clock.Now().Add(d), nil, f)
+}
+
+// ExecuteEvery runs f on the object goroutine every interval, the first time after interval.
+// Runs missed because the object was busy are skipped, not executed in a burst.
+func (this *ActiveObject) ExecuteEvery(interval time.Duration, f func()) (*ScheduledCommand, error) {
+	if interval <= 0 {
+		return nil, errors.New(fmt.Sprintf("ExecuteEvery interval must be positive, got %v", interval))
+	}
+	this.ensureInit()
+	next := func(prev time.Time) time.Time {
+		return prev.Add(interval)
+	}
+	return this.schedule(this.clock.Now().Add(interval), next, f)
+}
+
+// ExecuteCron runs f on the object goroutine at times matching the cron expression (see ParseCron)
+func (this *ActiveObject) ExecuteCron(expr string, f func()) (*ScheduledCommand, error) {
+	this.ensureInit()
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	return this.schedule(cron.Next(this.clock.Now()), cron.Next, f)
+}
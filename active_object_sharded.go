@@ -0,0 +1,180 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedExecutor routes commands to one of N ActiveObjects by a key hash. Commands with the
+// same key are executed serially in submission order, commands with different keys may run in parallel.
+type ShardedExecutor struct {
+	mutex       sync.RWMutex
+	shards      []*executorShard
+	cmdPoolSize int
+	stopped     bool
+}
+
+type executorShard struct {
+	ao       *ActiveObject
+	executed uint64
+}
+
+type ShardStats struct {
+	Index       int
+	QueueLength int
+	Executed    uint64
+}
+
+func NewShardedExecutor(shardCount int, cmdPoolSize int) *ShardedExecutor {
+	result := &ShardedExecutor{cmdPoolSize: cmdPoolSize}
+	shards, err := result.createShards(shardCount)
+	if err != nil {
+		panic(err)
+	}
+	result.shards = shards
+	return result
+}
+
+func (this *ShardedExecutor) createShards(shardCount int) ([]*executorShard, error) {
+	if shardCount <= 0 {
+		return nil, errors.New(fmt.Sprintf("Shard count must be positive, got %d", shardCount))
+	}
+	shards := make([]*executorShard, shardCount)
+	for i := range shards {
+		shard := &executorShard{ao: &ActiveObject{}}
+		shard.ao.Create1(this.cmdPoolSize)
+		shards[i] = shard
+	}
+	return shards, nil
+}
+
+func shardIndex(key string, shardCount int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shardCount))
+}
+
+// withShard calls f with the shard of the key, holding the read lock so that Resize cannot swap shards meanwhile
+func (this *ShardedExecutor) withShard(key string, f func(shard *executorShard) error) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.stopped {
+		return ErrStopped
+	}
+	return f(this.shards[shardIndex(key, len(this.shards))])
+}
+
+func (shard *executorShard) wrap(f func()) func() {
+	return func() {
+		defer atomic.AddUint64(&shard.executed, 1)
+		f()
+	}
+}
+
+func (this *ShardedExecutor) ExecuteAsync(key string, f func()) error {
+	return this.ExecuteAsyncCtx(context.Background(), key, f)
+}
+
+func (this *ShardedExecutor) ExecuteAsyncCtx(ctx context.Context, key string, f func()) error {
+	return this.withShard(key, func(shard *executorShard) error {
+		return shard.ao.ExecuteAsyncCtx(ctx, shard.wrap(f))
+	})
+}
+
+// ExecuteSyncCtx has the same semantics as ActiveObject.ExecuteSyncCtx
+func (this *ShardedExecutor) ExecuteSyncCtx(ctx context.Context, key string, f func()) error {
+	var wait func() error
+	err := this.withShard(key, func(shard *executorShard) error {
+		wait = shard.ao.submitSync(ctx, shard.wrap(f))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// NOTE: The read lock is not held while waiting, otherwise a concurrent Resize would block all submitters
+	return wait()
+}
+
+func (this *ShardedExecutor) ShardCount() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.shards)
+}
+
+// Resize replaces shards with shardCount new ones and drains the old ones. Commands submitted meanwhile
+// wait in the new shards until the old ones are drained, so the per key order is preserved even though
+// keys move between shards. Must not be called from a command running on the executor, and commands drained
+// from the old shards must not submit more commands than fit into a queue of a new shard.
+func (this *ShardedExecutor) Resize(shardCount int) error {
+	oldShards, drained, err := this.replaceShards(shardCount)
+	if err != nil || oldShards == nil {
+		return err
+	}
+	// NOTE: The old shards are drained without the lock, their commands may submit to the executor
+	err = stopShards(context.Background(), oldShards)
+	close(drained)
+	return err
+}
+
+// replaceShards swaps in new shards which do not start executing until drained is closed
+func (this *ShardedExecutor) replaceShards(shardCount int) ([]*executorShard, chan struct{}, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stopped {
+		return nil, nil, ErrStopped
+	}
+	if shardCount == len(this.shards) {
+		return nil, nil, nil
+	}
+	newShards, err := this.createShards(shardCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldShards := this.shards
+	this.shards = newShards
+	drained := make(chan struct{})
+	for _, shard := range this.shards {
+		shard.ao.enqueue(context.Background(), command{f: func() { <-drained }, internal: true})
+	}
+	return oldShards, drained, nil
+}
+
+func stopShards(ctx context.Context, shards []*executorShard) error {
+	for _, shard := range shards {
+		if err := shard.ao.Stop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *ShardedExecutor) Stats() []ShardStats {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	result := make([]ShardStats, len(this.shards))
+	for i, shard := range this.shards {
+		result[i] = ShardStats{
+			Index:       i,
+			QueueLength: len(shard.ao.cmdCh),
+			Executed:    atomic.LoadUint64(&shard.executed),
+		}
+	}
+	return result
+}
+
+// Stop drains and stops all shards. Commands being drained may still submit to the executor, they get ErrStopped.
+func (this *ShardedExecutor) Stop(ctx context.Context) error {
+	this.mutex.Lock()
+	this.stopped = true
+	shards := this.shards
+	this.mutex.Unlock()
+	return stopShards(ctx, shards)
+}
+
+func (this *ShardedExecutor) Destroy() {
+	this.Stop(context.Background())
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedExecutorKeepsPerKeyOrder(t *testing.T) {
+	executor := NewShardedExecutor(4, 16)
+	defer executor.Destroy()
+
+	var mutex sync.Mutex
+	results := map[string][]int{}
+	keys := []string{"alice", "bob", "carol", "dave", "eve"}
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			assert.NoError(t, executor.Resize(7))
+		}
+		for _, key := range keys {
+			key, i := key, i
+			executor.ExecuteAsync(key, func() {
+				mutex.Lock()
+				results[key] = append(results[key], i)
+				mutex.Unlock()
+			})
+		}
+	}
+	assert.NoError(t, executor.Stop(context.Background()))
+
+	for _, key := range keys {
+		assert.Equal(t, 100, len(results[key]), key)
+		for i, v := range results[key] {
+			assert.Equal(t, i, v, fmt.Sprintf("key %s", key))
+		}
+	}
+	assert.Equal(t, ErrStopped, executor.ExecuteAsync("alice", func() {}))
+}
+
+func TestShardedExecutorResizeDrainsCommandsWhichSubmit(t *testing.T) {
+	executor := NewShardedExecutor(2, 16)
+	defer executor.Destroy()
+
+	release := make(chan struct{})
+	done := make(chan int, 10)
+	executor.ExecuteAsync("alice", func() { <-release })
+	for i := 0; i < 3; i++ {
+		i := i
+		executor.ExecuteAsync("alice", func() {
+			executor.ExecuteAsync(fmt.Sprintf("key%d", i), func() { done <- i })
+		})
+	}
+	resized := make(chan error)
+	go func() { resized <- executor.Resize(3) }()
+	assert.Eventually(t, func() bool { return executor.ShardCount() == 3 }, time.Second, time.Millisecond)
+
+	// Submitting while the old shards drain works, the sync call waits for them
+	syncErr := make(chan error)
+	go func() { syncErr <- executor.ExecuteSyncCtx(context.Background(), "alice", func() {}) }()
+	close(release)
+	assert.NoError(t, <-resized)
+	assert.NoError(t, <-syncErr)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+}
+
+func TestShardedExecutorStopDrainsCommandsWhichSubmit(t *testing.T) {
+	executor := NewShardedExecutor(2, 16)
+	assert.Error(t, executor.Resize(0))
+	assert.Equal(t, 2, executor.ShardCount())
+
+	release := make(chan struct{})
+	submitErr := make(chan error, 1)
+	executor.ExecuteAsync("alice", func() { <-release })
+	executor.ExecuteAsync("alice", func() { submitErr <- executor.ExecuteAsync("bob", func() {}) })
+	stopped := make(chan error)
+	go func() { stopped <- executor.Stop(context.Background()) }()
+	assert.Eventually(t, func() bool { return executor.ExecuteAsync("carol", func() {}) == ErrStopped }, time.Second, time.Millisecond)
+	close(release)
+	assert.NoError(t, <-stopped)
+	assert.Equal(t, ErrStopped, <-submitErr)
+}
+
+func TestShardedExecutorStats(t *testing.T) {
+	executor := NewShardedExecutor(3, 0)
+	defer executor.Destroy()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, executor.ExecuteSyncCtx(context.Background(), "key", func() {}))
+	}
+	stats := executor.Stats()
+	assert.Equal(t, 3, len(stats))
+	total := uint64(0)
+	for i, s := range stats {
+		assert.Equal(t, i, s.Index)
+		total += s.Executed
+	}
+	assert.Equal(t, uint64(10), total)
+	assert.Equal(t, uint64(10), stats[shardIndex("key", 3)].Executed)
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+type SupervisorDirective int
+const (
+	SupervisorDirective_Restart SupervisorDirective = iota // Abandon the failed command, call OnRestart and continue with the next one
+	SupervisorDirective_Stop                               // Stop the failed object
+)
+
+// Supervisor decides what to do with ActiveObjects whose commands panic. A supervised object is restarted
+// while the group (all objects of the supervisor) fails no more than MaxRestarts times within Period.
+// When the limit is exceeded the failure is escalated to the parent supervisor, which may restart the whole
+// group, including child groups, within its own limit. When there is nobody left to escalate to, the whole
+// group is stopped. Restarting an object calls OnRestart, without it the object just resumes.
+type Supervisor struct {
+	MaxRestarts int
+	Period      time.Duration
+	OnPanic     func(ao *ActiveObject, err *PanicError) // Alerting hook, inherited from the parent when nil
+	OnRestart   func(ao *ActiveObject)                  // Resets the object state on its goroutine, inherited from the parent when nil
+
+	parent   *Supervisor
+	mutex    sync.Mutex
+	restarts []time.Time
+	objects  []*ActiveObject
+	children []*Supervisor
+}
+
+func NewSupervisor(maxRestarts int, period time.Duration) *Supervisor {
+	return &Supervisor{MaxRestarts: maxRestarts, Period: period}
+}
+
+// NewChild creates a supervisor which escalates to this one
+func (this *Supervisor) NewChild(maxRestarts int, period time.Duration) *Supervisor {
+	child := NewSupervisor(maxRestarts, period)
+	child.parent = this
+	this.mutex.Lock()
+	this.children = append(this.children, child)
+	this.mutex.Unlock()
+	return child
+}
+
+func (this *Supervisor) Supervise(ao *ActiveObject) {
+	ao.mutex.Lock()
+	ao.supervisor = this
+	ao.mutex.Unlock()
+	this.mutex.Lock()
+	this.objects = append(this.objects, ao)
+	this.mutex.Unlock()
+}
+
+func (this *Supervisor) notifyPanic(ao *ActiveObject, err *PanicError) {
+	for s := this; s != nil; s = s.parent {
+		if s.OnPanic != nil {
+			s.OnPanic(ao, err)
+			return
+		}
+	}
+}
+
+func (this *Supervisor) restartHook() func(ao *ActiveObject) {
+	for s := this; s != nil; s = s.parent {
+		if s.OnRestart != nil {
+			return s.OnRestart
+		}
+	}
+	return nil
+}
+
+// handleFailure is called on the goroutine of the failed object
+func (this *Supervisor) handleFailure(ao *ActiveObject) SupervisorDirective {
+	if this.tryRestart() {
+		this.restart(ao)
+		return SupervisorDirective_Restart
+	}
+	for s := this.parent; s != nil; s = s.parent {
+		if s.tryRestart() {
+			log.Warnf("Supervisor restart limit exceeded, escalated to parent, restarting the group")
+			this.resetRestarts()
+			this.restartGroup(ao)
+			return SupervisorDirective_Restart
+		}
+	}
+	log.Errorf("Supervisor restart limit exceeded, stopping the group")
+	this.requestStop(ao)
+	return SupervisorDirective_Stop
+}
+
+// tryRestart records a restart if it fits into the MaxRestarts per Period limit
+func (this *Supervisor) tryRestart() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := time.Now()
+	recent := this.restarts[:0]
+	for _, t := range this.restarts {
+		if now.Sub(t) < this.Period {
+			recent = append(recent, t)
+		}
+	}
+	this.restarts = recent
+	if len(this.restarts) >= this.MaxRestarts {
+		return false
+	}
+	this.restarts = append(this.restarts, now)
+	return true
+}
+
+// restart calls the restart hook for ao, which must be called on the ao goroutine
+func (this *Supervisor) restart(ao *ActiveObject) {
+	hook := this.restartHook()
+	if hook == nil {
+		return
+	}
+	if err := callWithRecover(func() { hook(ao) }); err != nil {
+		log.Errorf("Supervisor restart hook panicked: %v", err)
+	}
+}
+
+// restartGroup restarts all objects of the group and its child groups, the failed one right away
+// and the others by a command on their goroutines
+func (this *Supervisor) restartGroup(failed *ActiveObject) {
+	this.mutex.Lock()
+	objects := append([]*ActiveObject{}, this.objects...)
+	children := append([]*Supervisor{}, this.children...)
+	this.mutex.Unlock()
+	for _, ao := range objects {
+		if ao == failed {
+			this.restart(ao)
+			continue
+		}
+		ao := ao
+		if !ao.TryExecuteAsync(func() { this.restart(ao) }) {
+			log.Warnf("Supervisor could not restart an object of the group, it is stopped or its queue is full")
+		}
+	}
+	for _, child := range children {
+		child.resetRestarts()
+		child.restartGroup(failed)
+	}
+}
+
+func (this *Supervisor) resetRestarts() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.restarts = nil
+}
+
+// requestStop stops all objects of the group and its child groups without waiting, except the failed one
+// which is stopped by the caller
+func (this *Supervisor) requestStop(failed *ActiveObject) {
+	this.mutex.Lock()
+	objects := append([]*ActiveObject{}, this.objects...)
+	children := append([]*Supervisor{}, this.children...)
+	this.mutex.Unlock()
+	for _, ao := range objects {
+		if ao != failed {
+			ao.requestStop()
+		}
+	}
+	for _, child := range children {
+		child.requestStop(failed)
+	}
+}
+
+// Stop stops all supervised objects, including the ones of child supervisors, and waits for them
+func (this *Supervisor) Stop(ctx context.Context) error {
+	this.mutex.Lock()
+	objects := append([]*ActiveObject{}, this.objects...)
+	children := append([]*Supervisor{}, this.children...)
+	this.mutex.Unlock()
+	for _, child := range children {
+		if err := child.Stop(ctx); err != nil {
+			return err
+		}
+	}
+	for _, ao := range objects {
+		if err := ao.Stop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisorRestartsThenStops(t *testing.T) {
+	supervisor := NewSupervisor(2, time.Minute)
+	panics := int64(0)
+	supervisor.OnPanic = func(ao *ActiveObject, err *PanicError) { atomic.AddInt64(&panics, 1) }
+
+	ao := &ActiveObject{}
+	supervisor.Supervise(ao)
+	ao.Create1(10)
+
+	state := 0
+	supervisor.OnRestart = func(ao *ActiveObject) { state = 0 }
+
+	for i := 0; i < 2; i++ {
+		ao.ExecuteAsync(func() {
+			state = 1
+			panic("boom")
+		})
+		assert.NoError(t, ao.ExecuteSync(func() { assert.Equal(t, 0, state) }))
+	}
+	ao.ExecuteAsync(func() { panic("boom") })
+	<-ao.chDone
+	assert.Equal(t, ErrStopped, ao.ExecuteAsync(func() {}))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&panics))
+}
+
+func TestSupervisorEscalation(t *testing.T) {
+	root := NewSupervisor(1, time.Minute)
+	group := root.NewChild(0, time.Minute)
+	panics := int64(0)
+	root.OnPanic = func(ao *ActiveObject, err *PanicError) { atomic.AddInt64(&panics, 1) }
+	restarted := map[*ActiveObject]int{}
+	root.OnRestart = func(ao *ActiveObject) { restarted[ao]++ }
+
+	failing, sibling := &ActiveObject{}, &ActiveObject{}
+	group.Supervise(failing)
+	group.Supervise(sibling)
+	failing.Create1(10)
+	sibling.Create1(10)
+
+	// The child has no restarts of its own, the root restarts the group once
+	failing.ExecuteAsync(func() { panic("boom") })
+	assert.NoError(t, failing.ExecuteSync(func() {}))
+	assert.NoError(t, sibling.ExecuteSync(func() {}))
+	assert.Equal(t, map[*ActiveObject]int{failing: 1, sibling: 1}, restarted)
+
+	failing.ExecuteAsync(func() { panic("boom") })
+	assert.NoError(t, root.Stop(context.Background()))
+	assert.Equal(t, ErrStopped, sibling.ExecuteAsync(func() {}))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&panics))
+}
+
+func TestPerCommandPanicHandler(t *testing.T) {
+	ao := &ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+
+	handled := make(chan *PanicError, 1)
+	ao.ExecuteAsyncWithPanicHandler(func() { panic("boom") }, func(err *PanicError) { handled <- err })
+	assert.Equal(t, "boom", (<-handled).Value)
+	assert.NoError(t, ao.ExecuteSync(func() {}))
+}
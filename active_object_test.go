@@ -0,0 +1,493 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteSyncCtxReturnsPanicAsError(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(0)
+	defer ao.Destroy()
+
+	err := ao.ExecuteSyncCtx(context.Background(), func() { panic("boom") })
+	panicErr, ok := err.(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.Contains(t, panicErr.Stack, "TestExecuteSyncCtxReturnsPanicAsError")
+
+	result := 0
+	assert.NoError(t, ao.ExecuteSyncCtx(context.Background(), func() { result = 42 }))
+	assert.Equal(t, 42, result)
+}
+
+func TestExecuteSyncCtxDeadline(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(0)
+	defer ao.Destroy()
+
+	release := make(chan struct{})
+	ao.ExecuteAsync(func() { <-release })
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := ao.ExecuteSyncCtx(ctx, func() {})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestExecuteCtxAfterDestroy(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(0)
+	ao.Destroy()
+
+	assert.Equal(t, ErrDestroyed, ao.ExecuteAsyncCtx(context.Background(), func() {}))
+	assert.Equal(t, ErrDestroyed, ao.ExecuteSyncCtx(context.Background(), func() {}))
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+
+	release := make(chan struct{})
+	ao.ExecuteAsync(func() { <-release })
+	executed := 0
+	for i := 0; i < 5; i++ {
+		ao.ExecuteAsync(func() { executed++ })
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- ao.Stop(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.NoError(t, <-stopped)
+	assert.Equal(t, 5, executed)
+	assert.Equal(t, ErrStopped, ao.ExecuteAsync(func() {}))
+	assert.Equal(t, ErrStopped, ao.ExecuteSync(func() {}))
+}
+
+func TestStopRejectsQueue(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	ao.SetStopPolicy(StopPolicy_Reject)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	ao.ExecuteAsync(func() { close(started); <-release })
+	<-started
+	executed := 0
+	for i := 0; i < 5; i++ {
+		ao.ExecuteAsync(func() { executed++ })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, ao.Stop(ctx))
+	close(release)
+	assert.NoError(t, ao.Stop(context.Background()))
+	assert.Equal(t, 0, executed)
+}
+
+func TestMessageProcessorWakeup(t *testing.T) {
+	var mutex sync.Mutex
+	pending, processed := 0, 0
+	calls := int64(0)
+
+	ao := ActiveObject{}
+	ao.Create3(func() bool {
+		atomic.AddInt64(&calls, 1)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if pending == 0 {
+			return false
+		}
+		pending--
+		processed++
+		return true
+	}, NotifyIdleStrategy{}, 0)
+	defer ao.Destroy()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	mutex.Lock()
+	pending = 3
+	mutex.Unlock()
+	ao.Wakeup()
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return processed == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestBackoffIdleStrategy(t *testing.T) {
+	s := BackoffIdleStrategy{Min: time.Millisecond, Max: 5 * time.Millisecond}
+	assert.Equal(t, time.Millisecond, s.IdleDuration(1))
+	assert.Equal(t, 2*time.Millisecond, s.IdleDuration(2))
+	assert.Equal(t, 4*time.Millisecond, s.IdleDuration(3))
+	assert.Equal(t, 5*time.Millisecond, s.IdleDuration(4))
+	assert.Equal(t, 5*time.Millisecond, s.IdleDuration(100))
+
+	// Zero settings must not busy-spin
+	s = BackoffIdleStrategy{Max: time.Millisecond}
+	assert.Equal(t, MinIdleDuration, s.IdleDuration(1))
+	assert.Equal(t, 2*MinIdleDuration, s.IdleDuration(2))
+	assert.Equal(t, time.Millisecond, s.IdleDuration(100))
+	assert.Equal(t, MinIdleDuration, BackoffIdleStrategy{}.IdleDuration(10))
+	assert.Equal(t, MinIdleDuration, TickIdleStrategy{}.IdleDuration(1))
+}
+
+// Reports how many times an idle messageProcessor is called per millisecond, which is
+// proportional to the CPU burnt by an idle object
+func benchmarkIdleMessageProcessor(b *testing.B, strategy IdleStrategy) {
+	calls := int64(0)
+	ao := ActiveObject{}
+	ao.Create3(func() bool {
+		atomic.AddInt64(&calls, 1)
+		return false
+	}, strategy, 0)
+	defer ao.Destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&calls))/float64(b.N), "calls/ms")
+}
+
+func BenchmarkIdleNotify(b *testing.B) {
+	benchmarkIdleMessageProcessor(b, NotifyIdleStrategy{})
+}
+
+func BenchmarkIdleBackoff(b *testing.B) {
+	benchmarkIdleMessageProcessor(b, DefaultIdleStrategy)
+}
+
+func BenchmarkIdleTick(b *testing.B) {
+	benchmarkIdleMessageProcessor(b, TickIdleStrategy{Interval: 10 * time.Millisecond})
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	newBlocked := func(policy OverflowPolicy) (*ActiveObject, chan struct{}) {
+		ao := &ActiveObject{}
+		ao.Create1(2)
+		ao.SetOverflowPolicy(policy, 10*time.Millisecond)
+		started, release := make(chan struct{}), make(chan struct{})
+		ao.ExecuteAsync(func() { close(started); <-release })
+		<-started
+		return ao, release
+	}
+
+	ao, release := newBlocked(OverflowPolicy_Reject)
+	assert.True(t, ao.TryExecuteAsync(func() {}))
+	assert.NoError(t, ao.ExecuteAsync(func() {}))
+	assert.False(t, ao.TryExecuteAsync(func() {}))
+	assert.Equal(t, ErrQueueFull, ao.ExecuteAsync(func() {}))
+	close(release)
+	ao.Destroy()
+
+	// Cancel does not take a slot of the queue
+	ao, release = newBlocked(OverflowPolicy_Reject)
+	scheduled, err := ao.ExecuteAfter(time.Hour, func() {})
+	assert.NoError(t, err)
+	scheduled.Cancel()
+	assert.NoError(t, ao.ExecuteAsync(func() {}))
+	close(release)
+	ao.Destroy()
+	assert.Equal(t, uint64(2), ao.Stats().Executed) // The blocker and the async command, not the scheduling
+
+	ao, release = newBlocked(OverflowPolicy_BlockTimeout)
+	ao.ExecuteAsync(func() {})
+	ao.ExecuteAsync(func() {})
+	begin := time.Now()
+	assert.Equal(t, ErrQueueFull, ao.ExecuteAsync(func() {}))
+	assert.True(t, time.Since(begin) >= 10*time.Millisecond)
+	close(release)
+	ao.Destroy()
+
+	ao, release = newBlocked(OverflowPolicy_DropNewest)
+	executed := []int{}
+	for i := 0; i < 4; i++ {
+		i := i
+		ao.ExecuteAsync(func() { executed = append(executed, i) })
+	}
+	close(release)
+	ao.Destroy()
+	assert.Equal(t, []int{0, 1}, executed)
+
+	ao, release = newBlocked(OverflowPolicy_DropOldest)
+	executed = []int{}
+	syncErr := make(chan error)
+	go func() { syncErr <- ao.ExecuteSync(func() { executed = append(executed, -1) }) }()
+	assert.Eventually(t, func() bool { return len(ao.cmdCh) == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		i := i
+		assert.True(t, ao.TryExecuteAsync(func() { executed = append(executed, i) }))
+	}
+	assert.Equal(t, ErrDropped, <-syncErr)
+	close(release)
+	ao.Destroy()
+	assert.Equal(t, []int{1, 2}, executed)
+}
+
+func TestScheduledCommands(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+
+	fired := make(chan string, 100)
+	ao.ExecuteAfter(30*time.Millisecond, func() { fired <- "after" })
+	cancelled, _ := ao.ExecuteAfter(10*time.Millisecond, func() { fired <- "cancelled" })
+	cancelled.Cancel()
+	every, _ := ao.ExecuteEvery(5*time.Millisecond, func() { fired <- "every" })
+
+	counts := map[string]int{}
+	for counts["after"] == 0 {
+		counts[<-fired]++
+	}
+	every.Cancel()
+	ao.ExecuteSync(func() {})
+	for len(fired) > 0 {
+		counts[<-fired]++
+	}
+	assert.Equal(t, 0, counts["cancelled"])
+	assert.True(t, counts["every"] >= 3, counts["every"])
+
+	_, err := ao.ExecuteCron("bad", func() {})
+	assert.Error(t, err)
+	_, err = ao.ExecuteEvery(0, func() {})
+	assert.Error(t, err)
+}
+
+func TestReentrantExecuteSync(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+
+	var innerErr error
+	assert.NoError(t, ao.ExecuteSync(func() {
+		innerErr = ao.ExecuteSyncCtx(context.Background(), func() {})
+	}))
+	assert.Equal(t, ErrReentrantCall, innerErr)
+
+	ao.SetReentrancyMode(ReentrancyMode_Inline)
+	order := []string{}
+	assert.NoError(t, ao.ExecuteSync(func() {
+		ao.ExecuteSync(func() { order = append(order, "inner") })
+		order = append(order, "outer")
+	}))
+	assert.Equal(t, []string{"inner", "outer"}, order)
+}
+
+func TestReentrantExecuteSyncFromMessageProcessor(t *testing.T) {
+	ao := ActiveObject{}
+	errCh := make(chan error, 1)
+	done := false
+	ao.Create3(func() bool {
+		if !done {
+			done = true
+			errCh <- ao.ExecuteSync(func() {})
+		}
+		return false
+	}, NotifyIdleStrategy{}, 10)
+	defer ao.Destroy()
+	assert.Equal(t, ErrReentrantCall, <-errCh)
+	assert.NoError(t, ao.ExecuteSync(func() {}))
+}
+
+func TestActiveObjectStatsAndPrometheus(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+
+	release := make(chan struct{})
+	ao.ExecuteAsync(func() { <-release })
+	for i := 0; i < 3; i++ {
+		ao.ExecuteAsync(func() {})
+	}
+	close(release)
+	ao.ExecuteAsyncWithPanicHandler(func() { panic("boom") }, func(err *PanicError) {})
+	ao.ExecuteSync(func() {})
+
+	stats := ao.Stats()
+	assert.Equal(t, 0, stats.QueueDepth)
+	assert.Equal(t, 10, stats.QueueCapacity)
+	assert.True(t, stats.QueueHighWater >= 3)
+	assert.Equal(t, uint64(6), stats.Executed)
+	assert.Equal(t, uint64(1), stats.Panics)
+	assert.Equal(t, uint64(6), stats.ExecutionTime.Count)
+
+	registry := NewActiveObjectRegistry()
+	registry.Register("worker", &ao)
+	var buf strings.Builder
+	assert.NoError(t, registry.WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "activeobject_commands_executed_total{name=\"worker\"} 6\n")
+	assert.Contains(t, buf.String(), "activeobject_execution_seconds_bucket{name=\"worker\",le=\"+Inf\"} 6\n")
+	assert.Contains(t, buf.String(), "# TYPE activeobject_queue_wait_seconds histogram\n")
+}
+
+func TestBatchMode(t *testing.T) {
+	var mutex sync.Mutex
+	batches := []int{}
+	ao := ActiveObject{}
+	ao.CreateBatch(BatchConfig{
+		MaxSize: 4,
+		Linger:  20 * time.Millisecond,
+		AfterBatch: func(size int) {
+			mutex.Lock()
+			batches = append(batches, size)
+			mutex.Unlock()
+		},
+	}, 100)
+
+	release := make(chan struct{})
+	ao.ExecuteAsync(func() { <-release })
+	for i := 0; i < 10; i++ {
+		ao.ExecuteAsync(func() {})
+	}
+	close(release)
+	ao.Destroy()
+	assert.Equal(t, []int{4, 4, 3}, batches)
+}
+
+func TestBatchModeWithMessageProcessor(t *testing.T) {
+	batches := []int{}
+	processed := make(chan struct{}, 1)
+	ao := NewActiveObject(
+		WithCmdPoolSize(100),
+		WithBatch(BatchConfig{MaxSize: 4, AfterBatch: func(size int) { batches = append(batches, size) }}),
+		WithMessageProcessor(func() bool {
+			select {
+			case processed <- struct{}{}:
+			default:
+			}
+			return false
+		}, NotifyIdleStrategy{}))
+	for i := 0; i < 6; i++ {
+		ao.ExecuteAsync(func() {})
+	}
+	ao.Start()
+	assert.NoError(t, ao.ExecuteSync(func() {}))
+	<-processed
+	ao.Destroy()
+	assert.Equal(t, []int{4, 3}, batches)
+}
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	mutex sync.Mutex
+	ended []string
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+}
+
+func (this *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return context.WithValue(ctx, testSpanKey{}, name), &testSpan{this, RequestIdFromContext(ctx) + "/" + name}
+}
+
+func (this *testSpan) End() {
+	this.tracer.mutex.Lock()
+	defer this.tracer.mutex.Unlock()
+	this.tracer.ended = append(this.tracer.ended, this.name)
+}
+
+func TestContextPropagation(t *testing.T) {
+	ao := ActiveObject{}
+	ao.Create1(10)
+	defer ao.Destroy()
+	tracer := &testTracer{}
+	ao.SetTracer(tracer)
+
+	ctx, cancel := context.WithCancel(WithRequestId(context.Background(), "req-1"))
+	var requestId string
+	var span interface{}
+	var ctxErr error
+	done := make(chan struct{})
+	ao.ExecuteAsyncCtx(ctx, func() {
+		requestId = RequestIdFromContext(ao.Context())
+		span = ao.Context().Value(testSpanKey{})
+		ctxErr = ao.Context().Err()
+		close(done)
+	})
+	cancel()
+	<-done
+	ao.ExecuteSync(func() {})
+
+	assert.Equal(t, "req-1", requestId)
+	assert.Equal(t, "ActiveObject.execute", span)
+	assert.NoError(t, ctxErr)
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	assert.Equal(t, []string{"req-1/ActiveObject.queue", "req-1/ActiveObject.execute", "/ActiveObject.queue", "/ActiveObject.execute"}, tracer.ended)
+}
+
+func TestLifecycle(t *testing.T) {
+	events := make(chan string, 10)
+	ao := NewActiveObject(
+		WithCmdPoolSize(10),
+		WithOnStart(func() { events <- "start" }),
+		WithOnStop(func() { events <- "stop" }))
+	assert.Equal(t, ActiveObjectState_New, ao.State())
+
+	ao.ExecuteAsync(func() { events <- "command" })
+	assert.NoError(t, ao.Start())
+	assert.Equal(t, ErrAlreadyStarted, ao.Start())
+	assert.Equal(t, ActiveObjectState_Running, ao.State())
+
+	assert.NoError(t, ao.Stop(context.Background()))
+	assert.NoError(t, ao.Stop(context.Background()))
+	ao.Destroy()
+	assert.Equal(t, ActiveObjectState_Stopped, ao.State())
+	assert.Equal(t, ErrStopped, ao.Start())
+	close(events)
+	all := []string{}
+	for e := range events {
+		all = append(all, e)
+	}
+	assert.Equal(t, []string{"start", "command", "stop"}, all)
+
+	// Zero value and never started objects are safe to stop
+	var zero ActiveObject
+	zero.Destroy()
+	zero.Destroy()
+	assert.Equal(t, ActiveObjectState_Stopped, zero.State())
+
+	notStarted := NewActiveObject(WithCmdPoolSize(1))
+	future := Submit(notStarted, func() (int, error) { return 1, nil })
+	notStarted.Destroy()
+	_, err := future.Await(context.Background())
+	assert.Equal(t, ErrStopped, err)
+}
+
+func TestCreateAfterInitAndDestroy(t *testing.T) {
+	// Stats initializes the object before Create, which still applies its settings
+	ao := ActiveObject{}
+	ao.Stats()
+	processed := make(chan struct{}, 1)
+	ao.Create2(func() bool {
+		select {
+		case processed <- struct{}{}:
+		default:
+		}
+		return false
+	}, 5)
+	<-processed
+	assert.Equal(t, 5, ao.Stats().QueueCapacity)
+	ao.Destroy()
+
+	// Create after Destroy makes the object usable again
+	ao.Create1(3)
+	assert.NoError(t, ao.ExecuteSync(func() {}))
+	assert.Equal(t, 3, ao.Stats().QueueCapacity)
+	ao.Destroy()
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// ManualQueueSize is the queue size CreateManual uses when 0 is given, as an unbuffered queue would block senders forever
+const ManualQueueSize = 1024
+
+// CreateManual creates the object in test mode: there is no goroutine, commands are only queued and run
+// on the goroutine which calls Step or RunUntilIdle. Scheduled commands are due according to clock,
+// usually a *VirtualClock. A sync call in this mode steps the queue itself until its command is done.
+func (this *ActiveObject) CreateManual(clock Clock, cmdPoolSize int) {
+	if cmdPoolSize == 0 {
+		cmdPoolSize = ManualQueueSize
+	}
+	this.prepareCreate()
+	this.manual = true
+	this.clock = clock
+	this.cmdPoolSize = cmdPoolSize
+	this.ensureInit()
+	this.setState(ActiveObjectState_Running)
+	this.callHooks(this.onStart)
+}
+
+// Step runs one queued command, or all scheduled commands which are due, or messageProcessor once.
+// Returns false if there was nothing to do.
+func (this *ActiveObject) Step() bool {
+	if !this.manual {
+		panic("ActiveObject.Step can be used only in manual mode, see CreateManual")
+	}
+	this.stepMutex.Lock()
+	defer this.stepMutex.Unlock()
+
+	// The stepping goroutine acts as the object goroutine, so that re-entrant calls are detected
+	prevId := atomic.LoadUint64(&this.goroutineId)
+	atomic.StoreUint64(&this.goroutineId, currentGoroutineId())
+	defer atomic.StoreUint64(&this.goroutineId, prevId)
+
+	select {
+	case cmd := <-this.cmdCh:
+		this.handleCmd(cmd)
+		return true
+	default:
+	}
+	if len(this.scheduler.queue) > 0 && !this.scheduler.queue[0].at.After(this.clock.Now()) {
+		this.runDueScheduled()
+		return true
+	}
+	if this.messageProcessor != nil {
+		return this.messageProcessor()
+	}
+	return false
+}
+
+// RunUntilIdle steps until there is nothing to do, returns the number of steps made
+func (this *ActiveObject) RunUntilIdle() int {
+	steps := 0
+	for this.Step() {
+		steps++
+	}
+	return steps
+}
+
+func (this *ActiveObject) stepManualUntil(done func() bool) {
+	if !this.manual {
+		return
+	}
+	for !done() && this.Step() {
+	}
+}
+
+func (this *ActiveObject) stopManual() {
+	this.manualStop.Do(func() {
+		this.stepMutex.Lock()
+		defer this.stepMutex.Unlock()
+		this.scheduler.clear()
+		this.drainQueue()
+		this.callHooks(this.onStop)
+		this.setState(ActiveObjectState_Stopped)
+		close(this.chDone)
+	})
+}
+
+// QueuedCommands returns names of the queued commands' functions, oldest first. It can be used only
+// in manual mode, and no other goroutine may send commands meanwhile, as it takes the commands out
+// of the queue and puts them back.
+func (this *ActiveObject) QueuedCommands() []string {
+	if !this.manual {
+		panic("ActiveObject.QueuedCommands can be used only in manual mode, see CreateManual")
+	}
+	this.stepMutex.Lock()
+	defer this.stepMutex.Unlock()
+	n := len(this.cmdCh)
+	result := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		cmd := <-this.cmdCh
+		target := cmd.target
+		if target == nil {
+			target = cmd.f
+		}
+		result = append(result, funcName(target))
+		this.cmdCh <- cmd
+	}
+	return result
+}
+
+func AssertQueueLength(t assert.TestingT, ao *ActiveObject, expected int, msgAndArgs ...interface{}) bool {
+	return assert.Equal(t, expected, len(ao.cmdCh), msgAndArgs...)
+}
+
+// AssertQueuedCommands checks that each queued command function name ends with the corresponding suffix,
+// e.g. "(*Cache).evict" for a method value
+func AssertQueuedCommands(t assert.TestingT, ao *ActiveObject, nameSuffixes ...string) bool {
+	names := ao.QueuedCommands()
+	if !assert.Equal(t, len(nameSuffixes), len(names), "Queued commands: %v", names) {
+		return false
+	}
+	for i := range names {
+		if !strings.HasSuffix(names[i], nameSuffixes[i]) {
+			return assert.Fail(t, fmt.Sprintf("Queued command #%d is %s, expected *%s", i, names[i], nameSuffixes[i]))
+		}
+	}
+	return true
+}
+
+// AssertGoroutineStopped checks that the object goroutine has exited within timeout, e.g. after Destroy
+func AssertGoroutineStopped(t assert.TestingT, ao *ActiveObject, timeout time.Duration) bool {
+	select {
+	case <-ao.chDone:
+	case <-time.After(timeout):
+		return assert.Fail(t, "ActiveObject goroutine has not stopped")
+	}
+	id := atomic.LoadUint64(&ao.goroutineId)
+	if id == 0 || ao.manual {
+		return true
+	}
+	header := fmt.Sprintf("goroutine %d [", id)
+	deadline := time.Now().Add(timeout)
+	for strings.Contains(allGoroutineStacks(), header) {
+		if time.Now().After(deadline) {
+			return assert.Fail(t, fmt.Sprintf("ActiveObject goroutine %d is still alive", id))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
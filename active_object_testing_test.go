@@ -0,0 +1,108 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCache struct {
+	evicted int
+}
+
+func (this *testCache) evict() {
+	this.evicted++
+}
+
+func TestManualActiveObject(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ao := &ActiveObject{}
+	ao.CreateManual(clock, 0)
+
+	cache := &testCache{}
+	ao.ExecuteAsync(cache.evict)
+	ao.ExecuteAsync(cache.evict)
+	AssertQueuedCommands(t, ao, "(*testCache).evict-fm", "(*testCache).evict-fm")
+	assert.Equal(t, 0, cache.evicted)
+
+	assert.True(t, ao.Step())
+	assert.Equal(t, 1, cache.evicted)
+	AssertQueueLength(t, ao, 1)
+	assert.Panics(t, func() { (&ActiveObject{}).QueuedCommands() })
+
+	ticks := 0
+	ao.ExecuteEvery(time.Minute, func() { ticks++ })
+	assert.Equal(t, 2, ao.RunUntilIdle()) // The remaining evict and the ExecuteEvery registration
+	assert.Equal(t, 0, ticks)
+
+	clock.Advance(time.Minute)
+	ao.RunUntilIdle()
+	assert.Equal(t, 1, ticks)
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, 0, ao.RunUntilIdle())
+	clock.Advance(30 * time.Second)
+	ao.RunUntilIdle()
+	assert.Equal(t, 2, ticks)
+
+	// Sync calls step the queue themselves
+	assert.NoError(t, ao.ExecuteSyncCtx(context.Background(), cache.evict))
+	assert.Equal(t, 3, cache.evicted)
+
+	ao.Destroy()
+	AssertGoroutineStopped(t, ao, time.Second)
+}
+
+func TestVirtualClockDrivesRunningObject(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ao := &ActiveObject{}
+	ao.SetClock(clock)
+	ao.Create1(10)
+
+	fired := make(chan struct{}, 1)
+	ao.ExecuteAfter(time.Hour, func() { fired <- struct{}{} })
+	ao.ExecuteSync(func() {}) // Make sure the command is scheduled
+	clock.Advance(time.Hour)
+	<-fired
+
+	ao.Destroy()
+	AssertGoroutineStopped(t, ao, time.Second)
+}
+
+func TestSchedulerAlwaysAdvancesPeriodicCommands(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &scheduler{}
+	s.push(&ScheduledCommand{at: now, next: func(prev time.Time) time.Time { return prev }})
+	assert.Len(t, s.popDue(now), 1)
+	assert.Len(t, s.popDue(now), 0)
+	assert.Len(t, s.popDue(now.Add(time.Nanosecond)), 1)
+}
+
+func TestSchedulerRemovesCancelledCommands(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ao := &ActiveObject{}
+	ao.CreateManual(clock, 0)
+	ticks := 0
+	for i := 0; i < 100; i++ {
+		scheduled, err := ao.ExecuteAfter(time.Hour, func() { ticks++ })
+		assert.NoError(t, err)
+		ao.RunUntilIdle()
+		scheduled.Cancel()
+		scheduled.Cancel()
+	}
+	assert.True(t, len(ao.scheduler.queue) <= 2, "%d commands are scheduled", len(ao.scheduler.queue))
+
+	// Cancel before the command is pushed, and after a one-shot command is finished, is not counted
+	scheduled, _ := ao.ExecuteAfter(time.Hour, func() { ticks++ })
+	scheduled.Cancel()
+	finished, _ := ao.ExecuteAfter(time.Minute, func() { ticks++ })
+	ao.RunUntilIdle()
+	clock.Advance(time.Hour)
+	ao.RunUntilIdle()
+	assert.Equal(t, 1, ticks)
+	finished.Cancel()
+	assert.Empty(t, ao.scheduler.queue)
+	assert.Equal(t, int32(0), ao.scheduler.cancelled)
+
+	ao.Destroy()
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+type Span interface {
+	End()
+}
+
+// Tracer records spans of commands: "ActiveObject.queue" from enqueue to dequeue and "ActiveObject.execute"
+// around the command. Both are children of the span in the context given to ExecuteAsyncCtx/ExecuteSyncCtx.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+func (this *ActiveObject) SetTracer(tracer Tracer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.tracer = tracer
+}
+
+func (this *ActiveObject) getTracer() Tracer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.tracer
+}
+
+// Context returns the context the running command was submitted with, its values (request id, trace span)
+// are kept, but it is never cancelled. Must be called only from a command, on the object goroutine.
+func (this *ActiveObject) Context() context.Context {
+	if this.currentCtx == nil {
+		return context.Background()
+	}
+	return this.currentCtx
+}
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// RequestIdFromContext returns "" if there is no request id in ctx
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// LoggingTracer logs every finished span with its duration, request id and parent span
+type LoggingTracer struct {
+	lastSpanId uint64
+}
+
+var _ Tracer = (*LoggingTracer)(nil)
+
+type loggingSpan struct {
+	name      string
+	id        uint64
+	parentId  uint64
+	requestId string
+	started   time.Time
+}
+
+type loggingSpanKey struct{}
+
+func (this *LoggingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	span := &loggingSpan{
+		name:      name,
+		id:        atomic.AddUint64(&this.lastSpanId, 1),
+		requestId: RequestIdFromContext(ctx),
+		started:   time.Now(),
+	}
+	if parent, ok := ctx.Value(loggingSpanKey{}).(*loggingSpan); ok {
+		span.parentId = parent.id
+	}
+	return context.WithValue(ctx, loggingSpanKey{}, span), span
+}
+
+func (this *loggingSpan) End() {
+	log.WithFields(log.Fields{
+		"span":           this.name,
+		"span_id":        this.id,
+		"parent_span_id": this.parentId,
+		"request_id":     this.requestId,
+	}).Infof("Span %s finished in %v", this.name, time.Since(this.started))
+}
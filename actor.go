@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Actor owns a state value of type S. The state is reachable only through Tell, Ask and message
+// handlers, all of which run serially on the actor goroutine, so it needs no locking.
+type Actor[S any] struct {
+	ao       *ActiveObject
+	state    S
+	mutex    sync.RWMutex
+	handlers map[reflect.Type]func(state *S, msg interface{})
+}
+
+func NewActor[S any](initialState S, cmdPoolSize int) *Actor[S] {
+	result := &Actor[S]{state: initialState, handlers: map[reflect.Type]func(*S, interface{}){}}
+	result.ao = &ActiveObject{}
+	result.ao.Create1(cmdPoolSize)
+	return result
+}
+
+// ActiveObject gives access to the underlying object, e.g. for Stats or overflow policy settings
+func (this *Actor[S]) ActiveObject() *ActiveObject {
+	return this.ao
+}
+
+// Tell runs f with the state asynchronously
+func (this *Actor[S]) Tell(f func(state *S)) error {
+	return this.TellCtx(context.Background(), f)
+}
+
+func (this *Actor[S]) TellCtx(ctx context.Context, f func(state *S)) error {
+	return this.ao.ExecuteAsyncCtx(ctx, func() {
+		f(&this.state)
+	})
+}
+
+// Ask runs f with the state and returns its result, a panic in f is returned as *PanicError
+func Ask[S any, R any](actor *Actor[S], f func(state *S) R) (R, error) {
+	return AskCtx(context.Background(), actor, f)
+}
+
+func AskCtx[S any, R any](ctx context.Context, actor *Actor[S], f func(state *S) R) (R, error) {
+	var result R
+	err := actor.ao.ExecuteSyncCtx(ctx, func() {
+		result = f(&actor.state)
+	})
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	return result, nil
+}
+
+// Handle registers handler for messages of type M sent with Send, replacing a previous one
+func Handle[S any, M any](actor *Actor[S], handler func(state *S, msg M)) {
+	msgType := reflect.TypeOf((*M)(nil)).Elem()
+	actor.mutex.Lock()
+	defer actor.mutex.Unlock()
+	actor.handlers[msgType] = func(state *S, msg interface{}) {
+		handler(state, msg.(M))
+	}
+}
+
+// Send delivers msg asynchronously to the handler registered for its dynamic type
+func (this *Actor[S]) Send(msg interface{}) error {
+	msgType := reflect.TypeOf(msg)
+	this.mutex.RLock()
+	handler, ok := this.handlers[msgType]
+	this.mutex.RUnlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("Actor has no handler for message type %v", msgType))
+	}
+	return this.ao.ExecuteAsync(func() {
+		handler(&this.state, msg)
+	})
+}
+
+func (this *Actor[S]) Stop(ctx context.Context) error {
+	return this.ao.Stop(ctx)
+}
+
+func (this *Actor[S]) Destroy() {
+	this.ao.Destroy()
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAccount struct {
+	Balance int
+	History []string
+}
+
+type testDeposit struct {
+	Amount int
+}
+
+type testWithdraw struct {
+	Amount int
+}
+
+func TestActor(t *testing.T) {
+	actor := NewActor(testAccount{Balance: 10}, 10)
+	defer actor.Destroy()
+
+	Handle(actor, func(state *testAccount, msg testDeposit) {
+		state.Balance += msg.Amount
+		state.History = append(state.History, "deposit")
+	})
+	Handle(actor, func(state *testAccount, msg *testWithdraw) {
+		state.Balance -= msg.Amount
+		state.History = append(state.History, "withdraw")
+	})
+
+	assert.NoError(t, actor.Send(testDeposit{Amount: 5}))
+	assert.NoError(t, actor.Send(&testWithdraw{Amount: 3}))
+	assert.Error(t, actor.Send("unknown"))
+	assert.NoError(t, actor.Tell(func(state *testAccount) { state.Balance *= 2 }))
+
+	balance, err := Ask(actor, func(state *testAccount) int { return state.Balance })
+	assert.NoError(t, err)
+	assert.Equal(t, 24, balance)
+
+	history, err := Ask(actor, func(state *testAccount) []string { return append([]string{}, state.History...) })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deposit", "withdraw"}, history)
+
+	_, err = Ask(actor, func(state *testAccount) int { panic("boom") })
+	assert.IsType(t, &PanicError{}, err)
+}
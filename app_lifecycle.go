@@ -0,0 +1,298 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+const DefaultShutdownTimeout = 30 * time.Second
+
+// ErrStopSkipped is reported for components not stopped because an earlier one used up the shutdown timeout
+var ErrStopSkipped = errors.New("Skipped, shutdown timeout exceeded")
+
+// ErrShutdownForced is returned by Run when a second signal arrives while the app is stopping
+var ErrShutdownForced = errors.New("Shutdown forced by a second signal")
+
+// Component is a part of an App which is started and stopped with it
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// ComponentFuncs adapts a pair of functions to Component, nil functions do nothing
+type ComponentFuncs struct {
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+func (this ComponentFuncs) Start(ctx context.Context) error {
+	if this.OnStart == nil {
+		return nil
+	}
+	return this.OnStart(ctx)
+}
+
+func (this ComponentFuncs) Stop(ctx context.Context) error {
+	if this.OnStop == nil {
+		return nil
+	}
+	return this.OnStop(ctx)
+}
+
+// App starts registered components so that each one starts after its dependencies,
+// and stops them in the reverse order
+type App struct {
+	ShutdownTimeout time.Duration // For stopping all the components together
+	mutex           sync.Mutex
+	components      map[string]*appComponent
+	names           []string
+	started         []*appComponent
+}
+
+type appComponent struct {
+	name      string
+	component Component
+	dependsOn []string
+}
+
+// ComponentStopFailure describes a component which returned an error or did not stop within the shutdown timeout
+type ComponentStopFailure struct {
+	Name string
+	Err  error
+}
+
+type AppStopError struct {
+	Failures []ComponentStopFailure
+}
+
+func (this *AppStopError) Error() string {
+	messages := make([]string, len(this.Failures))
+	for i, failure := range this.Failures {
+		messages[i] = fmt.Sprintf("%s: %v", failure.Name, failure.Err)
+	}
+	return "App components failed to stop: " + strings.Join(messages, "; ")
+}
+
+func NewApp() *App {
+	return &App{
+		ShutdownTimeout: DefaultShutdownTimeout,
+		components:      map[string]*appComponent{},
+	}
+}
+
+func (this *App) Register(name string, component Component, dependsOn ...string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.components[name]; ok {
+		panic(errors.New(fmt.Sprintf("App component %s is already registered", name)))
+	}
+	this.components[name] = &appComponent{name: name, component: component, dependsOn: dependsOn}
+	this.names = append(this.names, name)
+}
+
+// startOrder sorts the components by dependencies, keeping the registration order otherwise
+func (this *App) startOrder() ([]*appComponent, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := map[string]int{}
+	var result []*appComponent
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		component, ok := this.components[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("App component %s depends on unknown component %s", path[len(path)-1], name))
+		}
+		switch marks[name] {
+		case visiting:
+			return errors.New(fmt.Sprintf("App components have a dependency cycle: %s -> %s", strings.Join(path, " -> "), name))
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dependency := range component.dependsOn {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		result = append(result, component)
+		return nil
+	}
+	for _, name := range this.names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Start starts all components. If one of them fails, the already started ones are stopped.
+func (this *App) Start(ctx context.Context) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.started) > 0 {
+		return errors.New("App is already started")
+	}
+	order, err := this.startOrder()
+	if err != nil {
+		return err
+	}
+	for _, component := range order {
+		log.Infof("Starting %s", component.name)
+		if err := component.component.Start(ctx); err != nil {
+			this.stopStarted()
+			return errors.New(fmt.Sprintf("App component %s failed to start, reason %v", component.name, err))
+		}
+		this.started = append(this.started, component)
+	}
+	return nil
+}
+
+// Stop stops the started components in the reverse order, within ShutdownTimeout for all of them.
+// Returns *AppStopError listing the components which failed or did not stop in time, and the ones
+// skipped after the timeout with ErrStopSkipped.
+func (this *App) Stop() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stopStarted()
+}
+
+func (this *App) stopStarted() error {
+	ctx, cancel := context.WithTimeout(context.Background(), this.ShutdownTimeout)
+	defer cancel()
+	var failures []ComponentStopFailure
+	for i := len(this.started) - 1; i >= 0; i-- {
+		component := this.started[i]
+		if ctx.Err() != nil {
+			log.Errorf("App component %s is not stopped, shutdown timeout exceeded", component.name)
+			failures = append(failures, ComponentStopFailure{Name: component.name, Err: ErrStopSkipped})
+			continue
+		}
+		log.Infof("Stopping %s", component.name)
+		started := time.Now()
+		if err := stopComponent(ctx, component.component); err != nil {
+			log.Errorf("App component %s failed to stop in %v, reason %v", component.name, time.Since(started), err)
+			failures = append(failures, ComponentStopFailure{Name: component.name, Err: err})
+		}
+	}
+	this.started = nil
+	if len(failures) > 0 {
+		return &AppStopError{Failures: failures}
+	}
+	return nil
+}
+
+// stopComponent does not wait for a component ignoring ctx longer than ctx allows
+func stopComponent(ctx context.Context, component Component) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- component.Stop(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run starts the app, waits for SIGINT, SIGTERM or ctx cancellation and stops the app.
+// A signal received while starting stops the app as soon as it is started. Another signal received while
+// stopping makes Run return ErrShutdownForced right away, the caller should exit then.
+func (this *App) Run(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := this.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+	case <-ctx.Done():
+		log.Infof("Shutting down, reason %v", ctx.Err())
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- this.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		return err
+	case sig := <-signals:
+		log.Warnf("Received %v while shutting down, forcing exit", sig)
+		return ErrShutdownForced
+	}
+}
+
+type activeObjectComponent struct {
+	ao *ActiveObject
+}
+
+// ActiveObjectComponent adapts ao to Component. An already started ao, e.g. made by Create, is fine.
+func ActiveObjectComponent(ao *ActiveObject) Component {
+	return activeObjectComponent{ao: ao}
+}
+
+func (this activeObjectComponent) Start(ctx context.Context) error {
+	if err := this.ao.Start(); err != nil && err != ErrAlreadyStarted {
+		return err
+	}
+	return nil
+}
+
+func (this activeObjectComponent) Stop(ctx context.Context) error {
+	return this.ao.Stop(ctx)
+}
+
+// HttpServerComponent serves an HttpRouter, stopping it waits for the requests in progress
+type HttpServerComponent struct {
+	router   *HttpRouter
+	server   *http.Server
+	listener net.Listener
+}
+
+func NewHttpServerComponent(router *HttpRouter, addr string) *HttpServerComponent {
+	return &HttpServerComponent{router: router, server: &http.Server{Addr: addr}}
+}
+
+// Start returns after the address is bound, so a busy port fails the start of the app
+func (this *HttpServerComponent) Start(ctx context.Context) error {
+	this.server.Handler = this.router.Handler()
+	listener, err := net.Listen("tcp", this.server.Addr)
+	if err != nil {
+		return err
+	}
+	this.listener = listener
+	go func() {
+		if err := this.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTP server %s failed, reason %v", this.server.Addr, err)
+		}
+	}()
+	return nil
+}
+
+func (this *HttpServerComponent) Stop(ctx context.Context) error {
+	return this.server.Shutdown(ctx)
+}
+
+// Addr returns the bound address, useful with port 0, or "" before Start
+func (this *HttpServerComponent) Addr() string {
+	if this.listener == nil {
+		return ""
+	}
+	return this.listener.Addr().String()
+}
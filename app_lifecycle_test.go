@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+type appEvents struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (this *appEvents) component(name string, startErr error, stopDelay time.Duration) Component {
+	return ComponentFuncs{
+		OnStart: func(ctx context.Context) error {
+			this.add("start " + name)
+			return startErr
+		},
+		OnStop: func(ctx context.Context) error {
+			this.add("stop " + name)
+			time.Sleep(stopDelay)
+			return nil
+		},
+	}
+}
+
+func (this *appEvents) add(event string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.events = append(this.events, event)
+}
+
+func TestAppStartsByDependenciesAndStopsInReverse(t *testing.T) {
+	events := &appEvents{}
+	app := NewApp()
+	app.Register("http", events.component("http", nil, 0), "cache", "db")
+	app.Register("cache", events.component("cache", nil, 0), "db")
+	app.Register("db", events.component("db", nil, 0))
+	app.Register("metrics", events.component("metrics", nil, 0))
+	assert.NoError(t, app.Start(context.Background()))
+	assert.NoError(t, app.Stop())
+	assert.Equal(t, []string{
+		"start db", "start cache", "start http", "start metrics",
+		"stop metrics", "stop http", "stop cache", "stop db",
+	}, events.events)
+}
+
+func TestAppStartFailureStopsStarted(t *testing.T) {
+	events := &appEvents{}
+	app := NewApp()
+	app.Register("db", events.component("db", nil, 0))
+	app.Register("http", events.component("http", errors.New("port is busy"), 0), "db")
+	assert.EqualError(t, app.Start(context.Background()), "App component http failed to start, reason port is busy")
+	assert.Equal(t, []string{"start db", "start http", "stop db"}, events.events)
+
+	app = NewApp()
+	app.Register("a", events.component("a", nil, 0), "b")
+	app.Register("b", events.component("b", nil, 0), "a")
+	assert.EqualError(t, app.Start(context.Background()), "App components have a dependency cycle: a -> b -> a")
+}
+
+func TestAppReportsComponentsNotStoppedInTime(t *testing.T) {
+	events := &appEvents{}
+	app := NewApp()
+	app.ShutdownTimeout = 50 * time.Millisecond
+	app.Register("early", events.component("early", nil, 0))
+	app.Register("stuck", events.component("stuck", nil, time.Second))
+	app.Register("late", events.component("late", nil, 0))
+	assert.NoError(t, app.Start(context.Background()))
+	started := time.Now()
+	err := app.Stop()
+	assert.True(t, time.Since(started) < time.Second)
+	stopErr, ok := err.(*AppStopError)
+	assert.True(t, ok)
+	assert.Equal(t, []ComponentStopFailure{
+		{Name: "stuck", Err: context.DeadlineExceeded},
+		{Name: "early", Err: ErrStopSkipped},
+	}, stopErr.Failures)
+}
+
+func TestAppRunStopsOnSignalDuringStart(t *testing.T) {
+	events := &appEvents{}
+	app := NewApp()
+	app.Register("db", ComponentFuncs{OnStart: func(ctx context.Context) error {
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}})
+	app.Register("http", events.component("http", nil, 0), "db")
+	assert.NoError(t, app.Run(context.Background()))
+	assert.Equal(t, []string{"start http", "stop http"}, events.events)
+}
+
+func TestAppRunStopsOnSignalAfterRequestsComplete(t *testing.T) {
+	router := NewHttpRouter()
+	handling := make(chan struct{})
+	router.DeclareRouteGET("slow", "/slow", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		close(handling)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	server := NewHttpServerComponent(router, "127.0.0.1:0")
+	ao := NewActiveObject()
+	app := NewApp()
+	app.Register("worker", ActiveObjectComponent(ao))
+	app.Register("http", server, "worker")
+	ready := make(chan struct{})
+	app.Register("ready", ComponentFuncs{OnStart: func(ctx context.Context) error {
+		close(ready)
+		return nil
+	}}, "http")
+
+	runResult := make(chan error, 1)
+	go func() {
+		runResult <- app.Run(context.Background())
+	}()
+	<-ready
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + server.Addr() + "/slow")
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(data)
+	}()
+	<-handling
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	assert.NoError(t, <-runResult)
+	assert.Equal(t, "done", <-body)
+	assert.Equal(t, ActiveObjectState_Stopped, ao.State())
+}
+
+func TestAppRunExitsOnSecondSignal(t *testing.T) {
+	app := NewApp()
+	stopping, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	app.Register("stuck", ComponentFuncs{OnStop: func(ctx context.Context) error {
+		close(stopping)
+		<-release
+		return nil
+	}})
+	ready := make(chan struct{})
+	app.Register("ready", ComponentFuncs{OnStart: func(ctx context.Context) error {
+		close(ready)
+		return nil
+	}}, "stuck")
+
+	runResult := make(chan error, 1)
+	go func() {
+		runResult <- app.Run(context.Background())
+	}()
+	<-ready
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	<-stopping
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	assert.Equal(t, ErrShutdownForced, <-runResult)
+}
+
+func TestHttpServerComponentAddrBeforeStart(t *testing.T) {
+	assert.Equal(t, "", NewHttpServerComponent(NewHttpRouter(), "127.0.0.1:0").Addr())
+}
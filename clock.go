@@ -0,0 +1,115 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts time for code which schedules things, so that tests can control it
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (this systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (this systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (this systemTimer) C() <-chan time.Time {
+	return this.timer.C
+}
+
+func (this systemTimer) Stop() bool {
+	return this.timer.Stop()
+}
+
+// VirtualClock is a Clock for tests, its time moves only with Advance and Set
+type VirtualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+var _ Clock = (*VirtualClock)(nil)
+
+type virtualTimer struct {
+	clock *VirtualClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (this *VirtualClock) Now() time.Time {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.now
+}
+
+func (this *VirtualClock) NewTimer(d time.Duration) ClockTimer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	timer := &virtualTimer{clock: this, at: this.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- this.now
+	} else {
+		this.timers = append(this.timers, timer)
+	}
+	return timer
+}
+
+// Advance moves the time forward and fires all timers which become due
+func (this *VirtualClock) Advance(d time.Duration) {
+	this.Set(this.Now().Add(d))
+}
+
+func (this *VirtualClock) Set(now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.now = now
+	pending := this.timers[:0]
+	for _, timer := range this.timers {
+		if timer.at.After(now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- now
+		}
+	}
+	this.timers = pending
+}
+
+func (this *virtualTimer) C() <-chan time.Time {
+	return this.ch
+}
+
+func (this *virtualTimer) Stop() bool {
+	this.clock.mutex.Lock()
+	defer this.clock.mutex.Unlock()
+	for i, timer := range this.clock.timers {
+		if timer == this {
+			this.clock.timers = append(this.clock.timers[:i], this.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
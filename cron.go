@@ -0,0 +1,162 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed standard 5-field cron expression: minute hour day-of-month month day-of-week.
+// Fields support *, lists (1,2), ranges (1-5), steps (*/15, 1-30/5) and month/day names (JAN, MON).
+// Descriptors @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly are supported too.
+type CronSchedule struct {
+	minutes uint64
+	hours   uint64
+	doms    uint64
+	months  uint64
+	dows    uint64
+	domStar bool
+	dowStar bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var cronDowNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New(fmt.Sprintf("Cron expression '%s' must have 5 fields, got %d", expr, len(fields)))
+	}
+	result := new(CronSchedule)
+	var err error
+	if result.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if result.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if result.doms, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if result.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, err
+	}
+	if result.dows, err = parseCronField(fields[4], 0, 7, cronDowNames); err != nil {
+		return nil, err
+	}
+	if result.dows&(1<<7) != 0 {
+		result.dows |= 1 // 7 is Sunday as well as 0
+	}
+	result.domStar = strings.HasPrefix(fields[2], "*")
+	result.dowStar = strings.HasPrefix(fields[4], "*")
+	return result, nil
+}
+
+func MustParseCron(expr string) *CronSchedule {
+	result, err := ParseCron(expr)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New(fmt.Sprintf("Bad step in cron field '%s'", field))
+			}
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, errors.New(fmt.Sprintf("Bad value in cron field '%s', reason %v", field, err))
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, errors.New(fmt.Sprintf("Bad value in cron field '%s', reason %v", field, err))
+				}
+			} else if step > 1 {
+				to = max // "5/15" means "5-max/15"
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, errors.New(fmt.Sprintf("Cron field '%s' is out of range %d-%d", field, min, max))
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func (this *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := this.doms&(1<<uint(t.Day())) != 0
+	dowMatch := this.dows&(1<<uint(t.Weekday())) != 0
+	if this.domStar || this.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch // Both restricted, cron matches either of them
+}
+
+// Next returns the first matching minute strictly after t, or zero time if there is none within 5 years
+func (this *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if this.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !this.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if this.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if this.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
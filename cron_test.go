@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2024, time.January, 31, 23, 58, 30, 0, time.UTC) // Wednesday
+
+	next := func(expr string, from time.Time) time.Time {
+		return MustParseCron(expr).Next(from)
+	}
+	assert.Equal(t, time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC), next("* * * * *", base))
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), next("*/15 * * * *", base))
+	assert.Equal(t, time.Date(2024, 2, 1, 9, 30, 0, 0, time.UTC), next("30 9 * * *", base))
+	assert.Equal(t, time.Date(2024, 2, 2, 9, 0, 0, 0, time.UTC), next("0 9 * * FRI", base))
+	assert.Equal(t, time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC), next("0 0 * * 7", base))
+	assert.Equal(t, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), next("0 12 29 FEB *", base))
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), next("@monthly", base))
+	assert.Equal(t, time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC), next("0 8-18/2 1,15 * MON", base))
+	assert.Equal(t, time.Date(2024, 2, 5, 8, 0, 0, 0, time.UTC), next("0 8 15 * MON", time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)))
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *", "x * * * *"} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
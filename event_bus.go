@@ -0,0 +1,227 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	log "github.com/Sirupsen/logrus"
+)
+
+const DefaultSubscriberQueueLimit = 1024
+
+var ErrNoSubscribers = errors.New("No subscribers for the topic")
+
+// EventMessage is passed to the handlers. Topics are dot separated, e.g. "orders.created.eu".
+type EventMessage struct {
+	Topic   string
+	Payload interface{}
+	replyCh chan interface{}
+}
+
+// Reply answers a message sent with EventBus.Request. Only the first reply is delivered,
+// false is returned for later ones and for messages sent with Publish.
+func (this *EventMessage) Reply(value interface{}) bool {
+	if this.replyCh == nil {
+		return false
+	}
+	select {
+	case this.replyCh <- value:
+		return true
+	default:
+		return false
+	}
+}
+
+type EventHandler func(msg *EventMessage)
+
+type SubscriberConfig struct {
+	QueueLimit int            // DefaultSubscriberQueueLimit by default
+	DropPolicy OverflowPolicy // What happens when the queue is full: DropNewest (default), DropOldest or Reject, which is the same as DropNewest
+}
+
+// EventBus delivers published messages to the handlers of matching subscriptions. Each Subscriber has its own
+// ActiveObject, so handlers of one subscriber are serialized, and a slow subscriber only drops its own messages,
+// publishers never block.
+type EventBus struct {
+	mutex         sync.RWMutex
+	subscriptions []*Subscription // Copy on write, Publish iterates without the lock
+}
+
+type Subscriber struct {
+	bus     *EventBus
+	ao      *ActiveObject
+	dropped uint64
+}
+
+type Subscription struct {
+	subscriber *Subscriber
+	pattern    []string
+	handler    EventHandler
+	active     int32
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+func (this *EventBus) NewSubscriber(config SubscriberConfig) *Subscriber {
+	if config.QueueLimit <= 0 {
+		config.QueueLimit = DefaultSubscriberQueueLimit
+	}
+	switch config.DropPolicy {
+	case OverflowPolicy_BlockTimeout:
+		panic(errors.New("Subscriber drop policy must not block publishers"))
+	case OverflowPolicy_Block, OverflowPolicy_Reject:
+		// Block is the zero value, publishers never block so it means the default
+		config.DropPolicy = OverflowPolicy_DropNewest
+	}
+	ao := NewActiveObject(WithCmdPoolSize(config.QueueLimit), WithOverflowPolicy(config.DropPolicy, 0))
+	ao.Start()
+	return &Subscriber{bus: this, ao: ao}
+}
+
+// Subscribe registers handler for topics matching pattern, where "*" matches exactly one segment
+// and "#" matches all remaining segments, possibly none
+func (this *Subscriber) Subscribe(pattern string, handler EventHandler) *Subscription {
+	subscription := &Subscription{
+		subscriber: this,
+		pattern:    strings.Split(pattern, "."),
+		handler:    handler,
+		active:     1,
+	}
+	for i, segment := range subscription.pattern {
+		if segment == "#" && i != len(subscription.pattern)-1 {
+			panic(errors.New(fmt.Sprintf("Wildcard # must be the last segment of pattern %s", pattern)))
+		}
+	}
+	bus := this.bus
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	subscriptions := make([]*Subscription, len(bus.subscriptions), len(bus.subscriptions)+1)
+	copy(subscriptions, bus.subscriptions)
+	bus.subscriptions = append(subscriptions, subscription)
+	return subscription
+}
+
+// Dropped returns the number of messages lost because the subscriber queue was full
+func (this *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// Close unsubscribes all subscriptions of the subscriber and stops it after the queued messages are handled
+func (this *Subscriber) Close(ctx context.Context) error {
+	this.bus.removeSubscriptions(func(subscription *Subscription) bool {
+		return subscription.subscriber == this
+	})
+	return this.ao.Stop(ctx)
+}
+
+// Unsubscribe stops the delivery, queued messages of the subscription are discarded
+func (this *Subscription) Unsubscribe() {
+	if !atomic.CompareAndSwapInt32(&this.active, 1, 0) {
+		return
+	}
+	this.subscriber.bus.removeSubscriptions(func(subscription *Subscription) bool {
+		return subscription == this
+	})
+}
+
+func (this *EventBus) removeSubscriptions(remove func(subscription *Subscription) bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var subscriptions []*Subscription
+	for _, subscription := range this.subscriptions {
+		if !remove(subscription) {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	this.subscriptions = subscriptions
+}
+
+func topicMatches(pattern []string, topic []string) bool {
+	for i, segment := range pattern {
+		if segment == "#" {
+			return true
+		}
+		if i >= len(topic) || (segment != "*" && segment != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// Publish delivers payload to all matching subscriptions and returns how many accepted it
+func (this *EventBus) Publish(topic string, payload interface{}) int {
+	return this.PublishCtx(context.Background(), topic, payload)
+}
+
+// PublishCtx is Publish passing ctx values to the handlers, see ActiveObject.Context
+func (this *EventBus) PublishCtx(ctx context.Context, topic string, payload interface{}) int {
+	delivered, _ := this.deliver(ctx, &EventMessage{Topic: topic, Payload: payload})
+	return delivered
+}
+
+func (this *EventBus) deliver(ctx context.Context, msg *EventMessage) (delivered int, matched int) {
+	this.mutex.RLock()
+	subscriptions := this.subscriptions
+	this.mutex.RUnlock()
+	topic := strings.Split(msg.Topic, ".")
+	for _, subscription := range subscriptions {
+		if !topicMatches(subscription.pattern, topic) {
+			continue
+		}
+		matched++
+		if subscription.enqueue(ctx, msg) {
+			delivered++
+		}
+	}
+	return delivered, matched
+}
+
+func (this *Subscription) enqueue(ctx context.Context, msg *EventMessage) bool {
+	subscriber := this.subscriber
+	cmd := command{
+		f: func() {
+			if atomic.LoadInt32(&this.active) == 1 {
+				this.handler(msg)
+			}
+		},
+		target: this.handler,
+		onReject: func(err error) {
+			if err == ErrDropped {
+				atomic.AddUint64(&subscriber.dropped, 1)
+			}
+		},
+		onPanic: func(err *PanicError) {
+			log.Errorf("EventBus handler of %s panicked: %v\n%s", msg.Topic, err.Value, err.Stack)
+		},
+	}
+	if err := subscriber.ao.enqueueExt(ctx, cmd, false); err != nil {
+		if err != ErrStopped {
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+		return false
+	}
+	return true
+}
+
+// Request publishes payload and waits for the first EventMessage.Reply of any matching handler
+func (this *EventBus) Request(ctx context.Context, topic string, payload interface{}) (interface{}, error) {
+	msg := &EventMessage{Topic: topic, Payload: payload, replyCh: make(chan interface{}, 1)}
+	delivered, matched := this.deliver(ctx, msg)
+	if matched == 0 {
+		return nil, ErrNoSubscribers
+	}
+	if delivered == 0 {
+		return nil, ErrDropped
+	}
+	select {
+	case reply := <-msg.replyCh:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		matches bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"*.created", "orders.created", true},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.created.eu", true},
+		{"#", "anything.at.all", true},
+		{"orders", "orders.created", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.matches, topicMatches(strings.Split(c.pattern, "."), strings.Split(c.topic, ".")), "%s ~ %s", c.pattern, c.topic)
+	}
+}
+
+func TestEventBusPublishAndUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	subscriber := bus.NewSubscriber(SubscriberConfig{})
+	var mutex sync.Mutex
+	var received []string
+	handler := func(msg *EventMessage) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, msg.Topic+"="+msg.Payload.(string))
+	}
+	all := subscriber.Subscribe("orders.#", handler)
+	subscriber.Subscribe("*.deleted", handler)
+
+	assert.Equal(t, 2, bus.Publish("orders.deleted", "a"))
+	assert.Equal(t, 1, bus.Publish("orders.created.eu", "b"))
+	assert.Equal(t, 0, bus.Publish("users.created", "c"))
+	subscriber.ao.ExecuteSync(func() {})
+	all.Unsubscribe()
+	assert.Equal(t, 1, bus.Publish("orders.deleted", "d"))
+	assert.NoError(t, subscriber.Close(context.Background()))
+	assert.Equal(t, 0, bus.Publish("orders.deleted", "e"))
+	assert.Equal(t, []string{"orders.deleted=a", "orders.deleted=a", "orders.created.eu=b", "orders.deleted=d"}, received)
+}
+
+func TestEventBusSlowSubscriberDoesNotBlockPublisher(t *testing.T) {
+	bus := NewEventBus()
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := bus.NewSubscriber(SubscriberConfig{QueueLimit: 2, DropPolicy: OverflowPolicy_DropOldest})
+	var received []int
+	slow.Subscribe("ticks", func(msg *EventMessage) {
+		handling <- struct{}{}
+		<-release
+		received = append(received, msg.Payload.(int))
+	})
+	bus.Publish("ticks", 0)
+	<-handling
+	started := time.Now()
+	for i := 1; i < 10; i++ {
+		bus.Publish("ticks", i)
+	}
+	assert.True(t, time.Since(started) < time.Second)
+	close(release)
+	go func() {
+		for range handling {
+		}
+	}()
+	assert.NoError(t, slow.Close(context.Background()))
+	close(handling)
+	// The first message was being handled, the queue kept the newest 2
+	assert.Equal(t, []int{0, 8, 9}, received)
+	assert.Equal(t, uint64(7), slow.Dropped())
+}
+
+func TestEventBusRequest(t *testing.T) {
+	bus := NewEventBus()
+	subscriber := bus.NewSubscriber(SubscriberConfig{})
+	defer subscriber.Close(context.Background())
+	subscriber.Subscribe("math.square", func(msg *EventMessage) {
+		n := msg.Payload.(int)
+		msg.Reply(n * n)
+	})
+	subscriber.Subscribe("math.ignore", func(msg *EventMessage) {})
+
+	reply, err := bus.Request(context.Background(), "math.square", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, 49, reply)
+
+	_, err = bus.Request(context.Background(), "math.unknown", 1)
+	assert.Equal(t, ErrNoSubscribers, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = bus.Request(ctx, "math.ignore", 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
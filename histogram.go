@@ -0,0 +1,67 @@
+package util
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are upper bounds in seconds, from 10us to 10s
+var DefaultLatencyBuckets = []float64{0.00001, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Histogram counts observations into buckets with fixed upper bounds, it is safe for concurrent use
+type Histogram struct {
+	bounds  []float64
+	counts  []uint64 // counts[i] is for (bounds[i-1], bounds[i]], the last one is for (last bound, +Inf)
+	sumBits uint64
+}
+
+type HistogramBucket struct {
+	UpperBound float64 // +Inf for the last bucket
+	Count      uint64  // Cumulative, as in Prometheus
+}
+
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket
+	Sum     float64
+	Count   uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := append([]float64{}, bounds...)
+	sort.Float64s(sorted)
+	return &Histogram{bounds: sorted, counts: make([]uint64, len(sorted)+1)}
+}
+
+func (this *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(this.bounds, value)
+	atomic.AddUint64(&this.counts[i], 1)
+	for {
+		oldBits := atomic.LoadUint64(&this.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + value)
+		if atomic.CompareAndSwapUint64(&this.sumBits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+func (this *Histogram) ObserveDuration(d time.Duration) {
+	this.Observe(d.Seconds())
+}
+
+func (this *Histogram) Snapshot() HistogramSnapshot {
+	result := HistogramSnapshot{Buckets: make([]HistogramBucket, len(this.counts))}
+	cumulative := uint64(0)
+	for i := range this.counts {
+		cumulative += atomic.LoadUint64(&this.counts[i])
+		bound := math.Inf(1)
+		if i < len(this.bounds) {
+			bound = this.bounds[i]
+		}
+		result.Buckets[i] = HistogramBucket{UpperBound: bound, Count: cumulative}
+	}
+	result.Count = cumulative
+	result.Sum = math.Float64frombits(atomic.LoadUint64(&this.sumBits))
+	return result
+}
@@ -2,11 +2,19 @@ package util
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 )
 
 type HttpError struct {
 	Code int
 	Message string
+	Errors []HttpFieldError // Problems of individual params, all of them are listed in the response
+}
+
+type HttpFieldError struct {
+	Param string `json:"param"`
+	Message string `json:"message"`
 }
 
 var _ error = &HttpError{}
@@ -28,6 +36,22 @@ func (err *HttpError) StatusCode() int {
 
 func (err *HttpError) Response() []byte {
 	jsonObj := map[string]interface{}{"code": err.Code, "message": err.Message}
+	if len(err.Errors) > 0 {
+		jsonObj["errors"] = err.Errors
+	}
 	return JsonEncode(jsonObj)
 }
 
+// CreateHttpValidationError makes a 400 error listing the names of the bad params in the message
+func CreateHttpValidationError(fieldErrors []HttpFieldError) HttpError {
+	names := make([]string, 0, len(fieldErrors))
+	for _, fieldError := range fieldErrors {
+		if len(names) == 0 || names[len(names)-1] != fieldError.Param {
+			names = append(names, fieldError.Param)
+		}
+	}
+	result := CreateHttpError(http.StatusBadRequest, "Invalid params: %s", strings.Join(names, ", "))
+	result.Errors = fieldErrors
+	return result
+}
+
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"github.com/julienschmidt/httprouter"
+)
+
+// HttpMiddleware wraps a route handler and may write the response itself without calling next. It runs before
+// the params are parsed, so it gets nil paramValues and it sees the 400 response for invalid params.
+// Params are available by ParamValuesFromRequest. Automatic OPTIONS responses run only the global middleware,
+// with an empty routeId.
+type HttpMiddleware func(next HttpHandler) HttpHandler
+
+type httpParamsKey struct{}
+
+// httpParamsParser parses the params of a request once, for the middleware and the route handler
+type httpParamsParser struct {
+	route  *HttpRoute
+	ps     httprouter.Params
+	once   sync.Once
+	values HttpParamValues
+	err    *HttpError
+}
+
+func (this *httpParamsParser) parse(r *http.Request) (HttpParamValues, *HttpError) {
+	this.once.Do(func() {
+		defer func() {
+			switch err := recover().(type) {
+			case nil:
+			case HttpError:
+				this.err = &err
+			case *HttpError:
+				this.err = err
+			default:
+				panic(err)
+			}
+		}()
+		this.values = this.route.parseParamValues(r, this.ps)
+	})
+	return this.values, this.err
+}
+
+// ParamValuesFromRequest parses the params of the route serving r, the result is reused by the route handler.
+// Invalid params are returned as a 400 *HttpError.
+func ParamValuesFromRequest(r *http.Request) (HttpParamValues, error) {
+	parser, ok := r.Context().Value(httpParamsKey{}).(*httpParamsParser)
+	if !ok {
+		return nil, errors.New("Request is not served by a declared route")
+	}
+	values, err := parser.parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// HttpRouteGroup declares routes under a path prefix, which share the middleware of the group
+type HttpRouteGroup struct {
+	router     *HttpRouter
+	parent     *HttpRouteGroup
+	prefix     string
+	middleware []HttpMiddleware
+}
+
+// Use adds middleware for all routes. Middleware runs in the order global, group, route,
+// and in the order of registration within each of them. It must be added before the router is served.
+func (this *HttpRouter) Use(middleware ...HttpMiddleware) {
+	this.middleware = append(this.middleware, middleware...)
+}
+
+// UseForRoute adds middleware for the declared route routeId
+func (this *HttpRouter) UseForRoute(routeId HttpRouteId, middleware ...HttpMiddleware) {
+	route, ok := this.routes[routeId]
+	if !ok {
+		panic(errors.New(fmt.Sprintf("Route %s not found, cannot add middleware", routeId)))
+	}
+	route.Middleware = append(route.Middleware, middleware...)
+}
+
+func (this *HttpRouter) Group(prefix string, middleware ...HttpMiddleware) *HttpRouteGroup {
+	return &HttpRouteGroup{router: this, prefix: strings.TrimRight(prefix, "/"), middleware: middleware}
+}
+
+// Group makes a nested group, its routes get the middleware of this group first
+func (this *HttpRouteGroup) Group(prefix string, middleware ...HttpMiddleware) *HttpRouteGroup {
+	return &HttpRouteGroup{router: this.router, parent: this, prefix: this.prefix + strings.TrimRight(prefix, "/"), middleware: middleware}
+}
+
+func (this *HttpRouteGroup) Use(middleware ...HttpMiddleware) {
+	this.middleware = append(this.middleware, middleware...)
+}
+
+func (this *HttpRouteGroup) allMiddleware() []HttpMiddleware {
+	if this.parent == nil {
+		return this.middleware
+	}
+	result := append([]HttpMiddleware{}, this.parent.allMiddleware()...)
+	return append(result, this.middleware...)
+}
+
+func (this *HttpRouteGroup) DeclareRoute(routeId HttpRouteId, method HttpMethod, path string, handler HttpHandler, params ...HttpParam) {
+	this.router.DeclareRoute(routeId, method, this.prefix + path, handler, params...)
+	this.router.routes[routeId].group = this
+}
+
+func (this *HttpRouteGroup) DeclareRouteGET(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_GET, path, handler, params...)
+}
+
+func (this *HttpRouteGroup) DeclareRoutePOST(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_POST, path, handler, params...)
+}
+
+func (this *HttpRouteGroup) DeclareRoutePUT(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_PUT, path, handler, params...)
+}
+
+func (this *HttpRouteGroup) DeclareRoutePATCH(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_PATCH, path, handler, params...)
+}
+
+func (this *HttpRouteGroup) DeclareRouteDELETE(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_DELETE, path, handler, params...)
+}
+
+// routeHandle serves the route through its middleware, the params are parsed after the middleware
+func (this *HttpRouter) routeHandle(routeId HttpRouteId, route *HttpRoute) httprouter.Handle {
+	all := append([]HttpMiddleware{}, this.middleware...)
+	if route.group != nil {
+		all = append(all, route.group.allMiddleware()...)
+	}
+	all = append(all, route.Middleware...)
+	handler := chainMiddleware(all, func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, _ HttpParamValues) {
+		paramValues, err := r.Context().Value(httpParamsKey{}).(*httpParamsParser).parse(r)
+		if err != nil {
+			this.errorRenderer(w, r, err, "")
+			return
+		}
+		route.Handler(routeId, w, r, paramValues)
+	})
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r = r.WithContext(context.WithValue(r.Context(), httpParamsKey{}, &httpParamsParser{route: route, ps: ps}))
+		handler(routeId, w, r, nil)
+	}
+}
+
+// optionsHandler answers OPTIONS requests of paths without a declared OPTIONS route, after the global middleware
+func (this *HttpRouter) optionsHandler() http.Handler {
+	handler := chainMiddleware(this.middleware, func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, _ HttpParamValues) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler("", w, r, nil)
+	})
+}
+
+// chainMiddleware wraps handler, so that the first middleware is the outermost one
+func chainMiddleware(all []HttpMiddleware, handler HttpHandler) HttpHandler {
+	for i := len(all) - 1; i >= 0; i-- {
+		handler = all[i](handler)
+	}
+	return handler
+}
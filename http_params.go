@@ -0,0 +1,378 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HttpParamKind defines the type of the parsed param value, a multiple param gets a slice of it
+type HttpParamKind int
+const (
+	HttpParamKind_String   HttpParamKind = iota // string
+	HttpParamKind_Int                           // int
+	HttpParamKind_Int64                         // int64
+	HttpParamKind_Float                         // float64
+	HttpParamKind_Bool                          // bool, as accepted by strconv.ParseBool
+	HttpParamKind_Duration                      // time.Duration, as accepted by time.ParseDuration
+	HttpParamKind_Time                          // time.Time, in HttpParam.Layout or time.RFC3339 by default
+	HttpParamKind_UUID                          // string
+	HttpParamKind_Enum                          // string, one of HttpParam.EnumValues
+)
+
+var httpParamKindNames = []string{"string", "int", "int64", "float", "bool", "duration", "time", "UUID", "enum"}
+
+var httpParamKindTypes = []reflect.Type{
+	reflect.TypeOf(""),
+	reflect.TypeOf(0),
+	reflect.TypeOf(int64(0)),
+	reflect.TypeOf(float64(0)),
+	reflect.TypeOf(false),
+	reflect.TypeOf(time.Duration(0)),
+	reflect.TypeOf(time.Time{}),
+	reflect.TypeOf(""),
+	reflect.TypeOf(""),
+}
+
+var uuidRegexp = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
+func (this HttpParamKind) String() string {
+	if this < 0 || int(this) >= len(httpParamKindNames) {
+		return fmt.Sprintf("HttpParamKind(%d)", int(this))
+	}
+	return httpParamKindNames[this]
+}
+
+func (this *HttpParam) timeLayout() string {
+	if this.Layout == "" {
+		return time.RFC3339
+	}
+	return this.Layout
+}
+
+func (this *HttpParam) expected() string {
+	switch this.Kind {
+	case HttpParamKind_Time:
+		return "time in layout " + this.timeLayout()
+	case HttpParamKind_Enum:
+		return "one of " + strings.Join(this.EnumValues, ", ")
+	}
+	return this.Kind.String()
+}
+
+func (this *HttpParam) convert(value string) (interface{}, error) {
+	switch this.Kind {
+	case HttpParamKind_String:
+		return value, nil
+	case HttpParamKind_Int:
+		return strconv.Atoi(value)
+	case HttpParamKind_Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case HttpParamKind_Float:
+		return strconv.ParseFloat(value, 64)
+	case HttpParamKind_Bool:
+		return strconv.ParseBool(value)
+	case HttpParamKind_Duration:
+		return time.ParseDuration(value)
+	case HttpParamKind_Time:
+		return time.Parse(this.timeLayout(), value)
+	case HttpParamKind_UUID:
+		if !uuidRegexp.MatchString(value) {
+			return nil, errors.New("Not a UUID")
+		}
+		return value, nil
+	case HttpParamKind_Enum:
+		for _, allowed := range this.EnumValues {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return nil, errors.New("Not an allowed value")
+	}
+	return nil, errors.New(fmt.Sprintf("Unexpected param kind: %v", this.Kind))
+}
+
+// convertValue panics with a 400 HttpError if value is not of the param kind
+func (this *HttpParam) convertValue(value string) interface{} {
+	result, err := this.convert(value)
+	if err != nil {
+		panic(CreateHttpError(http.StatusBadRequest, "Invalid value %q of param %s, expected %s", value, this.Name, this.expected()))
+	}
+	return result
+}
+
+// convertValues returns a slice of the param kind type, e.g. []int
+func (this *HttpParam) convertValues(values []string) interface{} {
+	if this.Kind == HttpParamKind_String {
+		return values
+	}
+	result := reflect.MakeSlice(reflect.SliceOf(httpParamKindTypes[this.Kind]), 0, len(values))
+	for _, value := range values {
+		result = reflect.Append(result, reflect.ValueOf(this.convertValue(value)))
+	}
+	return result.Interface()
+}
+
+// formatValues is the reverse of convertValue and convertValues, for CreateHttpRequest
+func (this *HttpParam) formatValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case int:
+		return []string{strconv.Itoa(v)}
+	case int64:
+		return []string{strconv.FormatInt(v, 10)}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'g', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case time.Duration:
+		return []string{v.String()}
+	case time.Time:
+		return []string{v.Format(this.timeLayout())}
+	}
+	slice := reflect.ValueOf(value)
+	if slice.Kind() != reflect.Slice {
+		panic(errors.New(fmt.Sprintf("Unsupported value %v of param %s", value, this.Name)))
+	}
+	result := make([]string, 0, slice.Len())
+	for i := 0; i < slice.Len(); i++ {
+		result = append(result, this.formatValues(slice.Index(i).Interface())...)
+	}
+	return result
+}
+
+// validateDeclaration panics if the param is declared inconsistently
+func (this *HttpParam) validateDeclaration() {
+	if this.Kind == HttpParamKind_Enum && len(this.EnumValues) == 0 {
+		panic(errors.New(fmt.Sprintf("Enum param %s has no EnumValues", this.Name)))
+	}
+	if this.DefaultValue != "" {
+		if _, err := this.convert(this.DefaultValue); err != nil {
+			panic(errors.New(fmt.Sprintf("Default value %q of param %s is not %s", this.DefaultValue, this.Name, this.expected())))
+		}
+	}
+}
+
+// HttpParamValues holds parsed values of the route params, of the types given by HttpParam.Kind.
+// The getters return the zero value for a missing param and panic if the param is of another kind.
+type HttpParamValues map[string]interface{}
+
+func (this HttpParamValues) Has(name string) bool {
+	_, ok := this[name]
+	return ok
+}
+
+func (this HttpParamValues) get(name string, result interface{}) {
+	value, ok := this[name]
+	if !ok {
+		return
+	}
+	target := reflect.ValueOf(result).Elem()
+	v := reflect.ValueOf(value)
+	if v.Type() != target.Type() {
+		panic(errors.New(fmt.Sprintf("Param %s is %T, not %v", name, value, target.Type())))
+	}
+	target.Set(v)
+}
+
+func (this HttpParamValues) GetString(name string) (result string) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetStrings(name string) (result []string) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetInt(name string) (result int) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetInts(name string) (result []int) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetInt64(name string) (result int64) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetFloat(name string) (result float64) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetBool(name string) (result bool) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetDuration(name string) (result time.Duration) {
+	this.get(name, &result)
+	return
+}
+
+func (this HttpParamValues) GetTime(name string) (result time.Time) {
+	this.get(name, &result)
+	return
+}
+
+// HttpParamConstraint checks a parsed param value, which is of the param kind type.
+// Constraints of a multiple param check each of its values.
+type HttpParamConstraint struct {
+	Description string // Shown by DescribeRoutes
+	Check       func(value interface{}) error
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func HttpParamMin(min float64) HttpParamConstraint {
+	return HttpParamConstraint{
+		Description: fmt.Sprintf("min %v", min),
+		Check: func(value interface{}) error {
+			v, ok := toFloat(value)
+			if !ok {
+				return errors.New("must be a number")
+			}
+			if v < min {
+				return errors.New(fmt.Sprintf("must be at least %v", min))
+			}
+			return nil
+		},
+	}
+}
+
+func HttpParamMax(max float64) HttpParamConstraint {
+	return HttpParamConstraint{
+		Description: fmt.Sprintf("max %v", max),
+		Check: func(value interface{}) error {
+			v, ok := toFloat(value)
+			if !ok {
+				return errors.New("must be a number")
+			}
+			if v > max {
+				return errors.New(fmt.Sprintf("must be at most %v", max))
+			}
+			return nil
+		},
+	}
+}
+
+// HttpParamMinLength counts characters, not bytes
+func HttpParamMinLength(min int) HttpParamConstraint {
+	return HttpParamConstraint{
+		Description: fmt.Sprintf("min length %d", min),
+		Check: func(value interface{}) error {
+			v, ok := value.(string)
+			if !ok {
+				return errors.New("must be a string")
+			}
+			if utf8.RuneCountInString(v) < min {
+				return errors.New(fmt.Sprintf("must be at least %d characters long", min))
+			}
+			return nil
+		},
+	}
+}
+
+func HttpParamMaxLength(max int) HttpParamConstraint {
+	return HttpParamConstraint{
+		Description: fmt.Sprintf("max length %d", max),
+		Check: func(value interface{}) error {
+			v, ok := value.(string)
+			if !ok {
+				return errors.New("must be a string")
+			}
+			if utf8.RuneCountInString(v) > max {
+				return errors.New(fmt.Sprintf("must be at most %d characters long", max))
+			}
+			return nil
+		},
+	}
+}
+
+// HttpParamPattern requires the whole value to match pattern
+func HttpParamPattern(pattern string) HttpParamConstraint {
+	re := regexp.MustCompile("^(?:" + pattern + ")$")
+	return HttpParamConstraint{
+		Description: "pattern " + pattern,
+		Check: func(value interface{}) error {
+			v, ok := value.(string)
+			if !ok {
+				return errors.New("must be a string")
+			}
+			if !re.MatchString(v) {
+				return errors.New("must match " + pattern)
+			}
+			return nil
+		},
+	}
+}
+
+func HttpParamOneOf(values ...string) HttpParamConstraint {
+	list := strings.Join(values, ", ")
+	return HttpParamConstraint{
+		Description: "one of " + list,
+		Check: func(value interface{}) error {
+			for _, allowed := range values {
+				if value == allowed {
+					return nil
+				}
+			}
+			return errors.New("must be one of " + list)
+		},
+	}
+}
+
+func HttpParamCustom(description string, check func(value interface{}) error) HttpParamConstraint {
+	return HttpParamConstraint{Description: description, Check: check}
+}
+
+// checkConstraints returns messages of all violated constraints. An optional string param
+// which is not given is not checked.
+func (this *HttpParam) checkConstraints(value interface{}) []string {
+	if this.IsMultiple {
+		var messages []string
+		slice := reflect.ValueOf(value)
+		for i := 0; i < slice.Len(); i++ {
+			messages = append(messages, this.checkValueConstraints(slice.Index(i).Interface())...)
+		}
+		return messages
+	}
+	if value == "" && this.IsOptional() {
+		return nil
+	}
+	return this.checkValueConstraints(value)
+}
+
+func (this *HttpParam) checkValueConstraints(value interface{}) []string {
+	var messages []string
+	for _, constraint := range this.Constraints {
+		if err := constraint.Check(value); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	return messages
+}
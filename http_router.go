@@ -8,21 +8,66 @@ import (
 	"fmt"
 	"strings"
 	"net/url"
+	"sync"
+	"io"
+	"sort"
+	"runtime/debug"
+	log "github.com/Sirupsen/logrus"
 )
 
 
+const defaultMaxMemory = 32 << 20 // The same as net/http uses for FormValue
+
 type HttpRouter struct {
 	router *httprouter.Router
 	routes map[HttpRouteId]*HttpRoute
+	routesAdded sync.Once
+	errorRenderer HttpErrorRenderer
+	middleware []HttpMiddleware
+}
+
+// HttpErrorRenderer writes the response for a panic in a route. A panic with an HttpError, e.g. from FormValueReq,
+// passes it as is and errorId is "". Any other panic is logged with its stack under a generated errorId
+// and becomes a 500 error.
+type HttpErrorRenderer func(w http.ResponseWriter, r *http.Request, err *HttpError, errorId string)
+
+func DefaultHttpErrorRenderer(w http.ResponseWriter, r *http.Request, err *HttpError, errorId string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	w.Write(err.Response())
 }
 
 func NewHttpRouter() *HttpRouter {
 	result := HttpRouter{}
 	result.router = httprouter.New()
 	result.routes = map[HttpRouteId]*HttpRoute{}
+	result.errorRenderer = DefaultHttpErrorRenderer
+	result.router.PanicHandler = result.handlePanic
 	return &result
 }
 
+func (this *HttpRouter) SetErrorRenderer(renderer HttpErrorRenderer) {
+	this.errorRenderer = renderer
+}
+
+func (this *HttpRouter) handlePanic(w http.ResponseWriter, r *http.Request, value interface{}) {
+	switch err := value.(type) {
+	case HttpError:
+		this.errorRenderer(w, r, &err, "")
+		return
+	case *HttpError:
+		this.errorRenderer(w, r, err, "")
+		return
+	}
+	if value == http.ErrAbortHandler {
+		panic(value) // The way to abort a response, net/http handles it
+	}
+	errorId := GenerateRandStr(16)
+	log.Errorf("Panic while serving %s %s, error id %s: %v\n%s", r.Method, r.URL.Path, errorId, value, debug.Stack())
+	err := CreateHttpError(http.StatusInternalServerError, "Internal server error, error id %s", errorId)
+	this.errorRenderer(w, r, &err, errorId)
+}
+
 type HttpRouteId string
 
 var _ fmt.Stringer = (*HttpRouteId)(nil)
@@ -31,8 +76,7 @@ func (this HttpRouteId) String() string {
 	return string(this)
 }
 
-// TODO: use typedef for paramValues map[string]interface{}
-type HttpHandler func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues map[string]interface{})
+type HttpHandler func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues)
 
 type HttpRoute struct {
 	Path string
@@ -41,6 +85,8 @@ type HttpRoute struct {
 	QueryParams []HttpParam
 	FormParams []HttpParam
 	Handler HttpHandler
+	Middleware []HttpMiddleware
+	group *HttpRouteGroup
 }
 
 func (this *HttpRoute) getAllParams() []HttpParam {
@@ -75,57 +121,88 @@ func (this *HttpRoute) getAllRequiredParams() []HttpParam {
 	return result
 }
 
-func (this *HttpRoute) parseParamValues(r *http.Request, ps httprouter.Params) map[string]interface{} {
-	paramValues := map[string]interface{}{}
+func (this *HttpRoute) parseParamValues(r *http.Request, ps httprouter.Params) HttpParamValues {
+	paramValues := HttpParamValues{}
+	var fieldErrors []HttpFieldError
 	for _, p := range this.UrlParams {
 		if p.IsMultiple {
 			panic(errors.New("You cannot not use IsMultiple=true for URL param"))
 		}
-		var val string
-		if p.IsRequired() {
-			val = ParamByNameReq(&ps, p.Name, this.Path)
-		} else {
-			val = ParamByNameOpt(&ps, p.Name, p.DefaultValue)
-		}
-		paramValues[p.Name] = val
-	}
-	for _, p := range this.QueryParams {
-		if p.IsMultiple {
-			if p.IsRequired() {
-				panic(errors.New("You should use IsMultiple=true only with ForceOptional=true"))
-			}
-			vals := r.URL.Query()[p.Name]
-			paramValues[p.Name] = vals
-		} else {
+		p.parse(paramValues, &fieldErrors, func() {
 			var val string
 			if p.IsRequired() {
-				val = QueryValueReq(r, p.Name, this.Path)
+				val = ParamByNameReq(&ps, p.Name, this.Path)
 			} else {
-				val = QueryValueOpt(r, p.Name, p.DefaultValue)
+				val = ParamByNameOpt(&ps, p.Name, p.DefaultValue)
 			}
-			paramValues[p.Name] = val
+			p.setValue(paramValues, val)
+		})
+	}
+	for _, p := range this.QueryParams {
+		if p.IsMultiple && p.IsRequired() {
+			panic(errors.New("You should use IsMultiple=true only with ForceOptional=true"))
 		}
+		p.parse(paramValues, &fieldErrors, func() {
+			if p.IsMultiple {
+				vals := r.URL.Query()[p.Name]
+				paramValues[p.Name] = p.convertValues(vals)
+			} else {
+				var val string
+				if p.IsRequired() {
+					val = QueryValueReq(r, p.Name, this.Path)
+				} else {
+					val = QueryValueOpt(r, p.Name, p.DefaultValue)
+				}
+				p.setValue(paramValues, val)
+			}
+		})
 	}
 	for _, p := range this.FormParams {
-		if p.IsMultiple {
-			if p.IsRequired() {
-				panic(errors.New("You should not use both IsMultiple=true and IsRequired=true"))
-			}
-			vals := r.URL.Query()[p.Name]
-			paramValues[p.Name] = vals
-		} else {
-			var val string
-			if p.IsRequired() {
-				val = FormValueReq(r, p.Name, this.Path)
+		if p.IsMultiple && p.IsRequired() {
+			panic(errors.New("You should not use both IsMultiple=true and IsRequired=true"))
+		}
+		p.parse(paramValues, &fieldErrors, func() {
+			if p.IsMultiple {
+				r.ParseMultipartForm(defaultMaxMemory) // ErrNotMultipart is fine, r.Form is parsed anyway
+				vals := r.Form[p.Name]
+				paramValues[p.Name] = p.convertValues(vals)
 			} else {
-				val = FormValueOpt(r, p.Name, p.DefaultValue)
+				var val string
+				if p.IsRequired() {
+					val = FormValueReq(r, p.Name, this.Path)
+				} else {
+					val = FormValueOpt(r, p.Name, p.DefaultValue)
+				}
+				p.setValue(paramValues, val)
 			}
-			paramValues[p.Name] = val
-		}
+		})
+	}
+	if len(fieldErrors) > 0 {
+		panic(CreateHttpValidationError(fieldErrors))
 	}
 	return paramValues
 }
 
+// parse calls setValue, which panics with an HttpError for a missing or malformed value, and checks
+// the constraints of the value. Problems are added to fieldErrors instead of panicking,
+// so that all of them get into one response.
+func (this *HttpParam) parse(paramValues HttpParamValues, fieldErrors *[]HttpFieldError, setValue func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			httpErr, ok := r.(HttpError)
+			if !ok {
+				panic(r)
+			}
+			*fieldErrors = append(*fieldErrors, HttpFieldError{Param: this.Name, Message: httpErr.Message})
+		}
+	}()
+	setValue()
+	if value, ok := paramValues[this.Name]; ok {
+		for _, message := range this.checkConstraints(value) {
+			*fieldErrors = append(*fieldErrors, HttpFieldError{Param: this.Name, Message: message})
+		}
+	}
+}
 
 type HttpParam struct {
 	Type HttpParamType
@@ -133,6 +210,19 @@ type HttpParam struct {
 	DefaultValue string // Has sense only when IsMultiple==false
 	ForceOptional bool
 	IsMultiple bool
+	Kind HttpParamKind
+	Layout string // For HttpParamKind_Time
+	EnumValues []string // For HttpParamKind_Enum
+	Constraints []HttpParamConstraint
+}
+
+// setValue converts val to the param kind. A missing optional value is kept as "" for a string param
+// and left out for other kinds.
+func (this *HttpParam) setValue(paramValues HttpParamValues, val string) {
+	if val == "" && this.Kind != HttpParamKind_String {
+		return
+	}
+	paramValues[this.Name] = this.convertValue(val)
 }
 
 func (this *HttpParam) IsRequired() bool {
@@ -150,12 +240,49 @@ const (
 	HttpParamType_Form
 )
 
+func (this HttpParamType) String() string {
+	switch this {
+	case HttpParamType_URL:
+		return "url"
+	case HttpParamType_Query:
+		return "query"
+	case HttpParamType_Form:
+		return "form"
+	}
+	return fmt.Sprintf("HttpParamType(%d)", int(this))
+}
+
 type HttpMethod int
 const (
 	HttpMethod_GET HttpMethod = iota
 	HttpMethod_POST
+	HttpMethod_PUT
+	HttpMethod_PATCH
+	HttpMethod_DELETE
+	HttpMethod_HEAD
+	HttpMethod_OPTIONS
 )
 
+var httpMethodNames = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+
+var _ fmt.Stringer = HttpMethod_GET
+
+func (this HttpMethod) String() string {
+	if this < 0 || int(this) >= len(httpMethodNames) {
+		return fmt.Sprintf("HttpMethod(%d)", int(this))
+	}
+	return httpMethodNames[this]
+}
+
+func ParseHttpMethod(method string) (HttpMethod, error) {
+	for i, name := range httpMethodNames {
+		if strings.EqualFold(name, method) {
+			return HttpMethod(i), nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Unsupported HTTP method: %s", method))
+}
+
 func NewHttpRoute(path string, method HttpMethod, params []HttpParam, handler HttpHandler) *HttpRoute {
 	re := regexp.MustCompile(":[\\w-]+")
 	urlParams := re.FindAllString(path, -1)
@@ -179,6 +306,10 @@ func NewHttpRoute(path string, method HttpMethod, params []HttpParam, handler Ht
 		return result
 	}
 
+	for i := range params {
+		params[i].validateDeclaration()
+	}
+
 	result := new(HttpRoute)
 	result.Path = path
 	result.Method = method
@@ -189,14 +320,41 @@ func NewHttpRoute(path string, method HttpMethod, params []HttpParam, handler Ht
 	return result
 }
 
-func (this *HttpRouter) DeclareRouteGET(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
-	route := NewHttpRoute(path, HttpMethod_GET, params, handler)
+func (this *HttpRouter) DeclareRoute(routeId HttpRouteId, method HttpMethod, path string, handler HttpHandler, params ...HttpParam) {
+	route := NewHttpRoute(path, method, params, handler)
 	this.routes[routeId] = route
 }
 
+func (this *HttpRouter) DeclareRouteGET(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_GET, path, handler, params...)
+}
+
 func (this *HttpRouter) DeclareRoutePOST(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
-	route := NewHttpRoute(path, HttpMethod_POST, params, handler)
-	this.routes[routeId] = route
+	this.DeclareRoute(routeId, HttpMethod_POST, path, handler, params...)
+}
+
+func (this *HttpRouter) DeclareRoutePUT(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_PUT, path, handler, params...)
+}
+
+func (this *HttpRouter) DeclareRoutePATCH(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_PATCH, path, handler, params...)
+}
+
+// DeclareRouteDELETE declares a route whose form params, if any, are read from the query string,
+// because net/http does not parse the body of a DELETE request
+func (this *HttpRouter) DeclareRouteDELETE(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_DELETE, path, handler, params...)
+}
+
+// DeclareRouteHEAD is needed only to override the HEAD route which is added for every GET route
+func (this *HttpRouter) DeclareRouteHEAD(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_HEAD, path, handler, params...)
+}
+
+// DeclareRouteOPTIONS is needed only to override the automatic OPTIONS response, which lists the allowed methods
+func (this *HttpRouter) DeclareRouteOPTIONS(routeId HttpRouteId, path string, handler HttpHandler, params ...HttpParam) {
+	this.DeclareRoute(routeId, HttpMethod_OPTIONS, path, handler, params...)
 }
 
 func (this *HttpRouter) BindRoute(routeId HttpRouteId, handler HttpHandler) {
@@ -211,27 +369,40 @@ func (this *HttpRouter) BindRoute(routeId HttpRouteId, handler HttpHandler) {
 }
 
 func (this *HttpRouter) addAllDeclaredRoutes() {
+	// Methods of every path, to add HEAD routes which are not declared explicitly
+	pathMethods := map[string]map[HttpMethod]bool{}
+	handles := map[HttpRouteId]httprouter.Handle{}
 	for k, _ := range this.routes {
 		route := this.routes[k]
-		var methodFunc func (string, httprouter.Handle)
-		if route.Method == HttpMethod_GET {
-			methodFunc = this.router.GET
-		} else if route.Method == HttpMethod_POST {
-			methodFunc = this.router.POST
-		} else {
+		if route.Method < 0 || int(route.Method) >= len(httpMethodNames) {
 			panic(errors.New(fmt.Sprintf("Unexpected method: %v", route.Method)))
 		}
-
 		if route.Handler == nil {
 			panic(errors.New(fmt.Sprintf("Route %v has unbinded handler, cannot use such route", route.Path)))
 		}
+		path := strings.TrimRight(route.Path, "/")
+		if pathMethods[path] == nil {
+			pathMethods[path] = map[HttpMethod]bool{}
+		}
+		pathMethods[path][route.Method] = true
 
 		routeId := k // ATTENTION: We need a copy of the outer routeId to put in the closure
-		this.addRoute(methodFunc, route.Path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			paramValues := route.parseParamValues(r, ps)
-			route.Handler(routeId, w, r, paramValues)
-		})
+		handle := this.routeHandle(routeId, route)
+		handles[routeId] = handle
+		this.addRoute(route.Method, route.Path, handle)
+	}
+	for k, _ := range this.routes {
+		route := this.routes[k]
+		path := strings.TrimRight(route.Path, "/")
+		if route.Method == HttpMethod_GET && !pathMethods[path][HttpMethod_HEAD] {
+			// net/http does not send the body of a HEAD response, so the GET handler answers it
+			this.addRoute(HttpMethod_HEAD, route.Path, handles[k])
+			pathMethods[path][HttpMethod_HEAD] = true
+		}
 	}
+	// OPTIONS requests of paths without a declared OPTIONS route are answered by httprouter with the Allow header
+	this.router.HandleOPTIONS = true
+	this.router.GlobalOPTIONS = this.optionsHandler()
 }
 
 func (this *HttpRouter) AddNotFoundRoute(handler http.HandlerFunc) {
@@ -239,14 +410,20 @@ func (this *HttpRouter) AddNotFoundRoute(handler http.HandlerFunc) {
 }
 
 func (this *HttpRouter) ListenAndServe(addr string) error {
-	this.addAllDeclaredRoutes()
-	return http.ListenAndServe(addr, this.router)
+	return http.ListenAndServe(addr, this.Handler())
 }
 
-func (this *HttpRouter) addRoute(methodFunc func (string, httprouter.Handle), route string, handler httprouter.Handle) {
+// Handler returns the router with all declared routes added, to be served by your own http.Server.
+// Routes must be declared and bound before the first call.
+func (this *HttpRouter) Handler() http.Handler {
+	this.routesAdded.Do(this.addAllDeclaredRoutes)
+	return this.router
+}
+
+func (this *HttpRouter) addRoute(method HttpMethod, route string, handler httprouter.Handle) {
 	routeNoTrailingSlash := strings.TrimRight(route, "/")
-	methodFunc(routeNoTrailingSlash, handler)
-	methodFunc(routeNoTrailingSlash + "/", handler)
+	this.router.Handle(method.String(), routeNoTrailingSlash, handler)
+	this.router.Handle(method.String(), routeNoTrailingSlash + "/", handler)
 }
 
 
@@ -268,12 +445,12 @@ func (this *HttpRequestParams) addParamValue(paramType HttpParamType, paramName
 	}
 	switch paramType {
 	case HttpParamType_URL:
-		this.URL = strings.Replace(this.URL, ":" + paramName, paramValue, -1)
+		this.URL = strings.Replace(this.URL, ":" + paramName, url.PathEscape(paramValue), -1)
 	case HttpParamType_Query:
 		if this.hasQueryValuesAdded {
-			this.URL = this.URL + "&" + paramName + "=" + paramValue
+			this.URL = this.URL + "&" + url.QueryEscape(paramName) + "=" + url.QueryEscape(paramValue)
 		} else {
-			this.URL = this.URL + "?" + paramName + "=" + paramValue
+			this.URL = this.URL + "?" + url.QueryEscape(paramName) + "=" + url.QueryEscape(paramValue)
 			this.hasQueryValuesAdded = true
 		}
 	case HttpParamType_Form:
@@ -281,7 +458,34 @@ func (this *HttpRequestParams) addParamValue(paramType HttpParamType, paramName
 	}
 }
 
-func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues map[string]interface{}) HttpRequestParams {
+// NewRequest builds the request to baseUrl + URL. Form values are sent in the body for POST, PUT and PATCH,
+// and in the query string for the other methods, where net/http does not parse the body.
+func (this *HttpRequestParams) NewRequest(baseUrl string) (*http.Request, error) {
+	requestUrl := baseUrl + this.URL
+	var body io.Reader
+	switch this.Method {
+	case HttpMethod_POST, HttpMethod_PUT, HttpMethod_PATCH:
+		body = strings.NewReader(this.Data.Encode())
+	default:
+		if len(this.Data) > 0 {
+			separator := "?"
+			if strings.Contains(requestUrl, "?") {
+				separator = "&"
+			}
+			requestUrl = requestUrl + separator + this.Data.Encode()
+		}
+	}
+	req, err := http.NewRequest(this.Method.String(), requestUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues HttpParamValues) HttpRequestParams {
 	route, ok := this.routes[routeId]
 	if !ok {
 		panic(errors.New(fmt.Sprintf("Route %v not found", routeId)))
@@ -300,7 +504,7 @@ func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues map[s
 		if !ok {
 			panic(errors.New(fmt.Sprintf("Value for required param %v is missing, route: %v", p.Name, routeId)))
 		}
-		valueStr := value.(string)
+		valueStr := p.formatValues(value)[0]
 		if valueStr == "" {
 			panic(fmt.Errorf("Cannot use empty string as value for required parameter %v, route: %v", p.Name, routeId))
 		}
@@ -320,7 +524,7 @@ func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues map[s
 				}
 				value = p.DefaultValue
 			}
-			result.addParamValue(p.Type, p.Name, value.(string))
+			result.addParamValue(p.Type, p.Name, p.formatValues(value)[0])
 
 		} else {
 			values, ok := paramValues[p.Name]
@@ -331,7 +535,7 @@ func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues map[s
 				}
 				values = defValues
 			}
-			stringValues := values.([]string)
+			stringValues := p.formatValues(values)
 			for j := range stringValues {
 				value := stringValues[j]
 				result.addParamValue(p.Type, p.Name, value)
@@ -340,4 +544,58 @@ func (this *HttpRouter) CreateHttpRequest(routeId HttpRouteId, paramValues map[s
 	}
 
 	return result
-}
\ No newline at end of file
+}
+
+
+type HttpRouteDescription struct {
+	Id HttpRouteId `json:"id"`
+	Method string `json:"method"`
+	Path string `json:"path"`
+	Params []HttpParamDescription `json:"params"`
+}
+
+type HttpParamDescription struct {
+	Name string `json:"name"`
+	In string `json:"in"`
+	Kind string `json:"kind"`
+	Required bool `json:"required"`
+	Multiple bool `json:"multiple,omitempty"`
+	DefaultValue string `json:"default,omitempty"`
+	Layout string `json:"layout,omitempty"`
+	EnumValues []string `json:"enum,omitempty"`
+	Constraints []string `json:"constraints,omitempty"`
+}
+
+// DescribeRoutes lists the declared routes sorted by path and method, e.g. to publish them as JSON
+func (this *HttpRouter) DescribeRoutes() []HttpRouteDescription {
+	result := make([]HttpRouteDescription, 0, len(this.routes))
+	for routeId, route := range this.routes {
+		description := HttpRouteDescription{Id: routeId, Method: route.Method.String(), Path: route.Path, Params: []HttpParamDescription{}}
+		for _, p := range route.getAllParams() {
+			paramDescription := HttpParamDescription{
+				Name: p.Name,
+				In: p.Type.String(),
+				Kind: p.Kind.String(),
+				Required: p.IsRequired(),
+				Multiple: p.IsMultiple,
+				DefaultValue: p.DefaultValue,
+				EnumValues: p.EnumValues,
+			}
+			if p.Kind == HttpParamKind_Time {
+				paramDescription.Layout = p.timeLayout()
+			}
+			for _, constraint := range p.Constraints {
+				paramDescription.Constraints = append(paramDescription.Constraints, constraint.Description)
+			}
+			description.Params = append(description.Params, paramDescription)
+		}
+		result = append(result, description)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Path != result[j].Path {
+			return result[i].Path < result[j].Path
+		}
+		return result[i].Method < result[j].Method
+	})
+	return result
+}
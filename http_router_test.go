@@ -0,0 +1,352 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func echoHandler(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+	w.Write(JsonEncode(map[string]interface{}{"route": routeId, "method": r.Method, "params": paramValues}))
+}
+
+func serveRequest(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func decodeHttpError(recorder *httptest.ResponseRecorder) HttpError {
+	var body struct {
+		Code    int              `json:"code"`
+		Message string           `json:"message"`
+		Errors  []HttpFieldError `json:"errors"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return HttpError{Code: body.Code, Message: body.Message, Errors: body.Errors}
+}
+
+func TestHttpMethodString(t *testing.T) {
+	assert.Equal(t, "PATCH", HttpMethod_PATCH.String())
+	method, err := ParseHttpMethod("delete")
+	assert.NoError(t, err)
+	assert.Equal(t, HttpMethod_DELETE, method)
+	_, err = ParseHttpMethod("TRACE")
+	assert.Error(t, err)
+}
+
+func TestHttpRouterRoundTripsAllMethods(t *testing.T) {
+	router := NewHttpRouter()
+	params := []HttpParam{
+		{Type: HttpParamType_URL, Name: "id"},
+		{Type: HttpParamType_Query, Name: "q"},
+		{Type: HttpParamType_Form, Name: "f"},
+		{Type: HttpParamType_Form, Name: "tags", ForceOptional: true, IsMultiple: true},
+	}
+	methods := []HttpMethod{HttpMethod_GET, HttpMethod_POST, HttpMethod_PUT, HttpMethod_PATCH, HttpMethod_DELETE}
+	for _, method := range methods {
+		router.DeclareRoute(HttpRouteId(method.String()), method, "/items/:id", echoHandler, params...)
+	}
+	handler := router.Handler()
+	for _, method := range methods {
+		request := router.CreateHttpRequest(HttpRouteId(method.String()), HttpParamValues{
+			"id": "a b", "q": "x&y", "f": "z", "tags": []string{"t1", "t2"},
+		})
+		req, err := request.NewRequest("")
+		assert.NoError(t, err)
+		resp := serveRequest(handler, req)
+		assert.Equal(t, http.StatusOK, resp.Code, method.String())
+		assert.Equal(t, map[string]interface{}{
+			"route":  method.String(),
+			"method": method.String(),
+			"params": map[string]interface{}{"id": "a b", "q": "x&y", "f": "z", "tags": []interface{}{"t1", "t2"}},
+		}, JsonParse(resp.Body.String()), method.String())
+	}
+}
+
+func TestHttpRouterHeadAndOptions(t *testing.T) {
+	router := NewHttpRouter()
+	router.DeclareRouteGET("get", "/items", echoHandler)
+	router.DeclareRoutePOST("post", "/items", echoHandler)
+	router.DeclareRouteDELETE("delete", "/items/:id", echoHandler, HttpParam{Type: HttpParamType_URL, Name: "id"})
+	router.DeclareRouteOPTIONS("options", "/items/:id", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		w.Header().Set("Allow", "custom")
+	}, HttpParam{Type: HttpParamType_URL, Name: "id"})
+	handler := router.Handler()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Head(server.URL + "/items")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+
+	recorder := serveRequest(handler, httptest.NewRequest("OPTIONS", "/items/", nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	allowed := strings.Split(recorder.Header().Get("Allow"), ", ")
+	sort.Strings(allowed)
+	assert.Equal(t, []string{"GET", "HEAD", "OPTIONS", "POST"}, allowed)
+
+	recorder = serveRequest(handler, httptest.NewRequest("OPTIONS", "/items/1", nil))
+	assert.Equal(t, "custom", recorder.Header().Get("Allow"))
+}
+
+func TestHttpRouterAcceptsDifferentWildcardNamesOfMethods(t *testing.T) {
+	router := NewHttpRouter()
+	router.DeclareRouteGET("get", "/users/:id", echoHandler, HttpParam{Type: HttpParamType_URL, Name: "id"})
+	router.DeclareRouteDELETE("delete", "/users/:userId", echoHandler, HttpParam{Type: HttpParamType_URL, Name: "userId"})
+	handler := router.Handler()
+	recorder := serveRequest(handler, httptest.NewRequest("OPTIONS", "/users/1", nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Allow"), "DELETE")
+}
+
+func TestHttpRouterTypedParams(t *testing.T) {
+	router := NewHttpRouter()
+	var got HttpParamValues
+	router.DeclareRouteGET("search", "/search/:id", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		got = paramValues
+	},
+		HttpParam{Type: HttpParamType_URL, Name: "id", Kind: HttpParamKind_UUID},
+		HttpParam{Type: HttpParamType_Query, Name: "limit", Kind: HttpParamKind_Int, DefaultValue: "10"},
+		HttpParam{Type: HttpParamType_Query, Name: "offset", Kind: HttpParamKind_Int64, ForceOptional: true},
+		HttpParam{Type: HttpParamType_Query, Name: "score", Kind: HttpParamKind_Float},
+		HttpParam{Type: HttpParamType_Query, Name: "exact", Kind: HttpParamKind_Bool, DefaultValue: "false"},
+		HttpParam{Type: HttpParamType_Query, Name: "timeout", Kind: HttpParamKind_Duration},
+		HttpParam{Type: HttpParamType_Query, Name: "since", Kind: HttpParamKind_Time, Layout: "2006-01-02"},
+		HttpParam{Type: HttpParamType_Query, Name: "sort", Kind: HttpParamKind_Enum, EnumValues: []string{"asc", "desc"}},
+		HttpParam{Type: HttpParamType_Query, Name: "page", Kind: HttpParamKind_Int, ForceOptional: true, IsMultiple: true},
+	)
+	handler := router.Handler()
+
+	request := router.CreateHttpRequest("search", HttpParamValues{
+		"id":      "123e4567-e89b-12d3-a456-426614174000",
+		"score":   0.5,
+		"timeout": 1500 * time.Millisecond,
+		"since":   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"sort":    "desc",
+		"page":    []int{1, 2},
+	})
+	req, _ := request.NewRequest("")
+	assert.Equal(t, http.StatusOK, serveRequest(handler, req).Code)
+	assert.Equal(t, "123e4567-e89b-12d3-a456-426614174000", got.GetString("id"))
+	assert.Equal(t, 10, got.GetInt("limit"))
+	assert.False(t, got.Has("offset"))
+	assert.Equal(t, int64(0), got.GetInt64("offset"))
+	assert.Equal(t, 0.5, got.GetFloat("score"))
+	assert.False(t, got.GetBool("exact"))
+	assert.Equal(t, 1500*time.Millisecond, got.GetDuration("timeout"))
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), got.GetTime("since"))
+	assert.Equal(t, []int{1, 2}, got.GetInts("page"))
+	assert.Panics(t, func() { got.GetString("limit") })
+
+	req = httptest.NewRequest("GET", "/search/123e4567-e89b-12d3-a456-426614174000?score=0.5&timeout=1s&since=2024-03-01&sort=random", nil)
+	httpErr := decodeHttpError(serveRequest(handler, req))
+	assert.Equal(t, []HttpFieldError{{Param: "sort", Message: `Invalid value "random" of param sort, expected one of asc, desc`}}, httpErr.Errors)
+	req = httptest.NewRequest("GET", "/search/42?score=0.5&timeout=1s&since=2024-03-01&sort=asc", nil)
+	httpErr = decodeHttpError(serveRequest(handler, req))
+	assert.Equal(t, []HttpFieldError{{Param: "id", Message: `Invalid value "42" of param id, expected UUID`}}, httpErr.Errors)
+
+	assert.Panics(t, func() {
+		router.DeclareRouteGET("bad", "/bad", echoHandler, HttpParam{Type: HttpParamType_Query, Name: "n", Kind: HttpParamKind_Int, DefaultValue: "ten"})
+	})
+}
+
+func TestHttpRouterCollectsAllViolations(t *testing.T) {
+	router := NewHttpRouter()
+	router.DeclareRoutePOST("create", "/users", echoHandler,
+		HttpParam{Type: HttpParamType_Form, Name: "name", Constraints: []HttpParamConstraint{HttpParamMinLength(2), HttpParamMaxLength(5)}},
+		HttpParam{Type: HttpParamType_Form, Name: "login", Constraints: []HttpParamConstraint{HttpParamPattern("[a-z]+"), HttpParamMinLength(4)}},
+		HttpParam{Type: HttpParamType_Form, Name: "age", Kind: HttpParamKind_Int, Constraints: []HttpParamConstraint{HttpParamMin(18), HttpParamMax(120)}},
+		HttpParam{Type: HttpParamType_Form, Name: "role", DefaultValue: "user", Constraints: []HttpParamConstraint{HttpParamOneOf("user", "admin")}},
+		HttpParam{Type: HttpParamType_Form, Name: "email"},
+		HttpParam{Type: HttpParamType_Form, Name: "nick", ForceOptional: true, Constraints: []HttpParamConstraint{HttpParamMinLength(3)}},
+		HttpParam{Type: HttpParamType_Form, Name: "scores", Kind: HttpParamKind_Int, ForceOptional: true, IsMultiple: true, Constraints: []HttpParamConstraint{
+			HttpParamCustom("even", func(value interface{}) error {
+				if value.(int)%2 != 0 {
+					return errors.New("must be even")
+				}
+				return nil
+			}),
+		}},
+	)
+	handler := router.Handler()
+
+	request := router.CreateHttpRequest("create", HttpParamValues{"name": "Bob", "login": "bob1", "age": 17, "role": "root", "email": "b@x", "scores": []int{2, 3}})
+	req, _ := request.NewRequest("")
+	resp := serveRequest(handler, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	httpErr := decodeHttpError(resp)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+	assert.Equal(t, "Invalid params: login, age, role, scores", httpErr.Message)
+	assert.Equal(t, []HttpFieldError{
+		{Param: "login", Message: "must match [a-z]+"},
+		{Param: "age", Message: "must be at least 18"},
+		{Param: "role", Message: "must be one of user, admin"},
+		{Param: "scores", Message: "must be even"},
+	}, httpErr.Errors)
+	assert.Equal(t, map[string]interface{}{
+		"code":    float64(400),
+		"message": "Invalid params: login, age, role, scores",
+		"errors": []interface{}{
+			map[string]interface{}{"param": "login", "message": "must match [a-z]+"},
+			map[string]interface{}{"param": "age", "message": "must be at least 18"},
+			map[string]interface{}{"param": "role", "message": "must be one of user, admin"},
+			map[string]interface{}{"param": "scores", "message": "must be even"},
+		},
+	}, JsonParse(resp.Body.String()))
+
+	request = router.CreateHttpRequest("create", HttpParamValues{"name": "Bob", "login": "bobby", "age": 30, "email": "b@x"})
+	req, _ = request.NewRequest("")
+	assert.Equal(t, http.StatusOK, serveRequest(handler, req).Code)
+}
+
+func TestHttpRouterDescribeRoutes(t *testing.T) {
+	router := NewHttpRouter()
+	router.DeclareRouteGET("list", "/items", echoHandler,
+		HttpParam{Type: HttpParamType_Query, Name: "limit", Kind: HttpParamKind_Int, DefaultValue: "10", Constraints: []HttpParamConstraint{HttpParamMin(1), HttpParamMax(100)}})
+	router.DeclareRouteDELETE("delete", "/items/:id", echoHandler, HttpParam{Type: HttpParamType_URL, Name: "id", Kind: HttpParamKind_UUID})
+	router.DeclareRoutePOST("create", "/items", echoHandler)
+	assert.Equal(t, []HttpRouteDescription{
+		{Id: "list", Method: "GET", Path: "/items", Params: []HttpParamDescription{
+			{Name: "limit", In: "query", Kind: "int", DefaultValue: "10", Constraints: []string{"min 1", "max 100"}},
+		}},
+		{Id: "create", Method: "POST", Path: "/items", Params: []HttpParamDescription{}},
+		{Id: "delete", Method: "DELETE", Path: "/items/:id", Params: []HttpParamDescription{
+			{Name: "id", In: "url", Kind: "UUID", Required: true},
+		}},
+	}, router.DescribeRoutes())
+}
+
+func TestHttpRouterRecoversPanics(t *testing.T) {
+	router := NewHttpRouter()
+	router.DeclareRouteGET("value", "/value", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		panic(CreateHttpError(http.StatusConflict, "Already exists"))
+	})
+	router.DeclareRouteGET("pointer", "/pointer", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		panic(&HttpError{Code: http.StatusForbidden, Message: "Forbidden"})
+	})
+	router.DeclareRouteGET("bug", "/bug", func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+		var m map[string]int
+		m["x"] = 1
+	})
+	router.DeclareRouteGET("required", "/required", echoHandler, HttpParam{Type: HttpParamType_Query, Name: "q"})
+	handler := router.Handler()
+
+	resp := serveRequest(handler, httptest.NewRequest("GET", "/value", nil))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `{"code":409,"message":"Already exists"}`, resp.Body.String())
+
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/pointer", nil))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/required", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, []HttpFieldError{{Param: "q", Message: "Argument q is not given, /required"}}, decodeHttpError(resp).Errors)
+
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/bug", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Regexp(t, "^Internal server error, error id [0-9a-zA-Z]{16}$", decodeHttpError(resp).Message)
+
+	var renderedId string
+	router.SetErrorRenderer(func(w http.ResponseWriter, r *http.Request, err *HttpError, errorId string) {
+		renderedId = errorId
+		w.WriteHeader(err.Code)
+		w.Write([]byte(err.Message))
+	})
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/bug", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "Internal server error, error id "+renderedId, resp.Body.String())
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/value", nil))
+	assert.Equal(t, "Already exists", resp.Body.String())
+	assert.Equal(t, "", renderedId)
+}
+
+func TestHttpRouterMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) HttpMiddleware {
+		return func(next HttpHandler) HttpHandler {
+			return func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+				calls = append(calls, name+":"+routeId.String())
+				next(routeId, w, r, paramValues)
+			}
+		}
+	}
+	requireToken := func(next HttpHandler) HttpHandler {
+		return func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+			if r.URL.Query().Get("token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next(routeId, w, r, paramValues)
+		}
+	}
+	router := NewHttpRouter()
+	router.Use(trace("global1"), trace("global2"))
+	router.DeclareRouteGET("health", "/health", echoHandler)
+	api := router.Group("/api", trace("api"))
+	admin := api.Group("/admin/", requireToken)
+	admin.Use(trace("admin"))
+	admin.DeclareRouteDELETE("deleteUser", "/users/:id", echoHandler,
+		HttpParam{Type: HttpParamType_URL, Name: "id", Kind: HttpParamKind_Int},
+		HttpParam{Type: HttpParamType_Query, Name: "token", ForceOptional: true})
+	router.UseForRoute("deleteUser", trace("route"))
+	assert.Panics(t, func() { router.UseForRoute("missing", trace("route")) })
+	handler := router.Handler()
+
+	resp := serveRequest(handler, httptest.NewRequest("DELETE", "/api/admin/users/7?token=secret", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"global1:deleteUser", "global2:deleteUser", "api:deleteUser", "admin:deleteUser", "route:deleteUser"}, calls)
+
+	calls = nil
+	resp = serveRequest(handler, httptest.NewRequest("DELETE", "/api/admin/users/7", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, []string{"global1:deleteUser", "global2:deleteUser", "api:deleteUser"}, calls)
+
+	// Invalid params are not reported before the middleware runs
+	resp = serveRequest(handler, httptest.NewRequest("DELETE", "/api/admin/users/x", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = serveRequest(handler, httptest.NewRequest("DELETE", "/api/admin/users/x?token=secret", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	calls = nil
+	resp = serveRequest(handler, httptest.NewRequest("HEAD", "/health", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"global1:health", "global2:health"}, calls)
+
+	calls = nil
+	resp = serveRequest(handler, httptest.NewRequest("OPTIONS", "/health", nil))
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, []string{"global1:", "global2:"}, calls)
+}
+
+func TestHttpRouterMiddlewareReadsParams(t *testing.T) {
+	router := NewHttpRouter()
+	var seen []int
+	router.Use(func(next HttpHandler) HttpHandler {
+		return func(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+			if values, err := ParamValuesFromRequest(r); err == nil {
+				seen = append(seen, values.GetInt("id"))
+			}
+			next(routeId, w, r, paramValues)
+		}
+	})
+	router.DeclareRouteGET("get", "/items/:id", echoHandler, HttpParam{Type: HttpParamType_URL, Name: "id", Kind: HttpParamKind_Int})
+	handler := router.Handler()
+	resp := serveRequest(handler, httptest.NewRequest("GET", "/items/5", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, map[string]interface{}{"id": float64(5)}, JsonParse(resp.Body.String()).(map[string]interface{})["params"])
+	resp = serveRequest(handler, httptest.NewRequest("GET", "/items/x", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, []int{5}, seen)
+}
@@ -0,0 +1,322 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	log "github.com/Sirupsen/logrus"
+)
+
+const journalFileName = "journal.jsonl"
+const snapshotFileName = "snapshot.json"
+
+type JournalConfig struct {
+	Dir           string // Directory for the journal and snapshot files, created if missing
+	SnapshotEvery int    // Write a snapshot after this many events, 0 disables automatic snapshots
+	CmdPoolSize   int
+	Fsync         bool // Sync the journal file after every event, and the snapshot file before the journal is truncated
+}
+
+// JournaledActor is an actor whose state changes only by events. Each event is appended to a JSON lines
+// journal before it is applied. On Open the state is rebuilt from the latest snapshot plus the journal tail.
+// Event types must be registered with RegisterEvent before Open, and both the state and the events must
+// survive a JSON round trip.
+type JournaledActor[S any] struct {
+	config        JournalConfig
+	actor         *Actor[S]
+	journal       *os.File
+	journalSize   int64
+	seq           uint64
+	sinceSnapshot int
+	eventNames    map[reflect.Type]string
+	appliers      map[string]func(state *S, data json.RawMessage) error
+	applyTyped    map[string]func(state *S, event interface{})
+}
+
+type journalEntry struct {
+	Seq  uint64          `json:"seq"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type journalSnapshot struct {
+	Seq   uint64          `json:"seq"`
+	State json.RawMessage `json:"state"`
+}
+
+func NewJournaledActor[S any](config JournalConfig) *JournaledActor[S] {
+	return &JournaledActor[S]{
+		config:     config,
+		eventNames: map[reflect.Type]string{},
+		appliers:   map[string]func(*S, json.RawMessage) error{},
+		applyTyped: map[string]func(*S, interface{}){},
+	}
+}
+
+// RegisterEvent declares the event type E under a name which is stored in the journal, so the name must stay stable
+func RegisterEvent[S any, E any](actor *JournaledActor[S], name string, apply func(state *S, event E)) {
+	if actor.actor != nil {
+		panic(errors.New(fmt.Sprintf("Event %s must be registered before Open", name)))
+	}
+	actor.eventNames[reflect.TypeOf((*E)(nil)).Elem()] = name
+	actor.applyTyped[name] = func(state *S, event interface{}) {
+		apply(state, event.(E))
+	}
+	actor.appliers[name] = func(state *S, data json.RawMessage) error {
+		var event E
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		apply(state, event)
+		return nil
+	}
+}
+
+// Open recovers the state, starting from initialState if there is no snapshot, and starts the actor
+func (this *JournaledActor[S]) Open(initialState S) error {
+	if err := os.MkdirAll(this.config.Dir, 0755); err != nil {
+		return err
+	}
+	state := initialState
+	snapshotSeq, err := this.loadSnapshot(&state)
+	if err != nil {
+		return err
+	}
+	this.seq = snapshotSeq
+	if err := this.replayJournal(&state, snapshotSeq); err != nil {
+		return err
+	}
+	this.journal, err = os.OpenFile(this.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := this.journal.Stat()
+	if err != nil {
+		this.journal.Close()
+		return err
+	}
+	this.journalSize = info.Size()
+	this.actor = NewActor(state, this.config.CmdPoolSize)
+	return nil
+}
+
+func (this *JournaledActor[S]) journalPath() string {
+	return filepath.Join(this.config.Dir, journalFileName)
+}
+
+func (this *JournaledActor[S]) snapshotPath() string {
+	return filepath.Join(this.config.Dir, snapshotFileName)
+}
+
+func (this *JournaledActor[S]) loadSnapshot(state *S) (uint64, error) {
+	data, err := ioutil.ReadFile(this.snapshotPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var snapshot journalSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, errors.New(fmt.Sprintf("Cannot decode snapshot %s, reason %v", this.snapshotPath(), err))
+	}
+	if err := json.Unmarshal(snapshot.State, state); err != nil {
+		return 0, errors.New(fmt.Sprintf("Cannot decode snapshot state %s, reason %v", this.snapshotPath(), err))
+	}
+	return snapshot.Seq, nil
+}
+
+// replayJournal applies events after snapshotSeq. A broken last line is a write torn by a crash,
+// it is cut off; a broken line in the middle is an error.
+func (this *JournaledActor[S]) replayJournal(state *S, snapshotSeq uint64) error {
+	data, err := ioutil.ReadFile(this.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	offset := 0
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) == 0 && readErr == io.EOF {
+			return nil
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil || readErr == io.EOF {
+			if offset+len(line) < len(data) {
+				return errors.New(fmt.Sprintf("Journal %s is corrupted at offset %d, reason %v", this.journalPath(), offset, err))
+			}
+			log.Warnf("Cutting off torn last entry of journal %s at offset %d", this.journalPath(), offset)
+			return os.Truncate(this.journalPath(), int64(offset))
+		}
+		offset += len(line)
+		if entry.Seq <= snapshotSeq {
+			continue
+		}
+		applier, ok := this.appliers[entry.Type]
+		if !ok {
+			return errors.New(fmt.Sprintf("Journal %s has unregistered event type %s", this.journalPath(), entry.Type))
+		}
+		if panicErr := callWithRecover(func() { err = applier(state, entry.Data) }); panicErr != nil {
+			err = panicErr
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Cannot apply event %d of type %s, reason %v", entry.Seq, entry.Type, err))
+		}
+		this.seq = entry.Seq
+		this.sinceSnapshot++
+	}
+}
+
+// Persist appends event to the journal and applies it to the state, on the actor goroutine.
+// A panic of the event handler is returned as *PanicError and the event is cut off the journal,
+// so handlers should validate the event before changing the state.
+func (this *JournaledActor[S]) Persist(event interface{}) error {
+	return this.PersistCtx(context.Background(), event)
+}
+
+func (this *JournaledActor[S]) PersistCtx(ctx context.Context, event interface{}) error {
+	name, ok := this.eventNames[reflect.TypeOf(event)]
+	if !ok {
+		return errors.New(fmt.Sprintf("Event type %T is not registered", event))
+	}
+	result, err := AskCtx(ctx, this.actor, func(state *S) error {
+		var line []byte
+		entry := journalEntry{Seq: this.seq + 1, Type: name}
+		if err := callWithRecover(func() {
+			entry.Data = JsonEncode(event)
+			line = append(JsonEncode(entry), '\n')
+		}); err != nil {
+			return err
+		}
+		prevSize := this.journalSize
+		if err := this.append(line); err != nil {
+			return err
+		}
+		if err := callWithRecover(func() { this.applyTyped[name](state, event) }); err != nil {
+			this.cutJournal(prevSize)
+			return err
+		}
+		this.seq = entry.Seq
+		this.sinceSnapshot++
+		if this.config.SnapshotEvery > 0 && this.sinceSnapshot >= this.config.SnapshotEvery {
+			if err := this.writeSnapshot(state); err != nil {
+				log.Errorf("Cannot write snapshot to %s, reason %v", this.snapshotPath(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// append writes line to the journal, a partially written line is cut off
+func (this *JournaledActor[S]) append(line []byte) error {
+	_, err := this.journal.Write(line)
+	if err == nil && this.config.Fsync {
+		err = this.journal.Sync()
+	}
+	if err != nil {
+		this.cutJournal(this.journalSize)
+		return err
+	}
+	this.journalSize += int64(len(line))
+	return nil
+}
+
+// cutJournal truncates the journal to size, removing entries written after it
+func (this *JournaledActor[S]) cutJournal(size int64) {
+	if err := this.journal.Truncate(size); err != nil {
+		log.Errorf("Cannot cut journal %s to %d bytes, reason %v", this.journalPath(), size, err)
+		return
+	}
+	if this.config.Fsync {
+		if err := this.journal.Sync(); err != nil {
+			log.Errorf("Cannot sync journal %s, reason %v", this.journalPath(), err)
+		}
+	}
+	this.journalSize = size
+}
+
+// Snapshot writes the state snapshot now and truncates the journal
+func (this *JournaledActor[S]) Snapshot() error {
+	result, err := Ask(this.actor, func(state *S) error {
+		return this.writeSnapshot(state)
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// writeSnapshot replaces the snapshot file atomically and then truncates the journal. If the process dies
+// in between, the journal entries already covered by the snapshot are skipped by their seq on replay.
+func (this *JournaledActor[S]) writeSnapshot(state *S) error {
+	snapshot := journalSnapshot{Seq: this.seq, State: JsonEncode(state)}
+	tmpPath := this.snapshotPath() + ".tmp"
+	if err := this.writeFile(tmpPath, JsonEncode(snapshot)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, this.snapshotPath()); err != nil {
+		return err
+	}
+	if this.config.Fsync {
+		// The rename must be durable before the journal is truncated
+		if err := syncDir(this.config.Dir); err != nil {
+			return err
+		}
+	}
+	this.sinceSnapshot = 0
+	if err := this.journal.Truncate(0); err != nil {
+		return err
+	}
+	this.journalSize = 0
+	return nil
+}
+
+func (this *JournaledActor[S]) writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && this.config.Fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Read runs f with the state on the actor goroutine, f must not modify the state
+func Read[S any, R any](actor *JournaledActor[S], f func(state *S) R) (R, error) {
+	return Ask(actor.actor, f)
+}
+
+// Close stops the actor and closes the journal
+func (this *JournaledActor[S]) Close(ctx context.Context) error {
+	if err := this.actor.Stop(ctx); err != nil {
+		return err
+	}
+	return this.journal.Close()
+}
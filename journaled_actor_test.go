@@ -0,0 +1,114 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type testLedger struct {
+	Balance int      `json:"balance"`
+	Log     []string `json:"log"`
+}
+
+type testCredited struct {
+	Amount int `json:"amount"`
+}
+
+type testUnencodable struct {
+	Ch chan int `json:"ch"`
+}
+
+type testNoted struct {
+	Text string `json:"text"`
+}
+
+func openTestLedger(t *testing.T, dir string) *JournaledActor[testLedger] {
+	actor := NewJournaledActor[testLedger](JournalConfig{Dir: dir, SnapshotEvery: 3})
+	RegisterEvent(actor, "credited", func(state *testLedger, e testCredited) { state.Balance += e.Amount })
+	RegisterEvent(actor, "noted", func(state *testLedger, e testNoted) { state.Log = append(state.Log, e.Text) })
+	assert.NoError(t, actor.Open(testLedger{}))
+	return actor
+}
+
+func TestJournaledActorRecovery(t *testing.T) {
+	dir := t.TempDir()
+	actor := openTestLedger(t, dir)
+	for i := 1; i <= 4; i++ {
+		assert.NoError(t, actor.Persist(testCredited{Amount: i}))
+	}
+	assert.NoError(t, actor.Persist(testNoted{Text: "hello"}))
+	assert.Error(t, actor.Persist("not registered"))
+	assert.NoError(t, actor.Close(context.Background()))
+
+	// The snapshot covers 3 events, the journal has the other 2
+	journal, _ := ioutil.ReadFile(filepath.Join(dir, journalFileName))
+	assert.Equal(t, 2, strings.Count(string(journal), "\n"))
+
+	actor = openTestLedger(t, dir)
+	state, err := Read(actor, func(state *testLedger) testLedger { return *state })
+	assert.NoError(t, err)
+	assert.Equal(t, testLedger{Balance: 10, Log: []string{"hello"}}, state)
+	assert.NoError(t, actor.Close(context.Background()))
+
+	// A torn last line is cut off
+	f, _ := os.OpenFile(filepath.Join(dir, journalFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"seq":6,"type":"cred`)
+	f.Close()
+	actor = openTestLedger(t, dir)
+	assert.NoError(t, actor.Persist(testCredited{Amount: 5}))
+	balance, _ := Read(actor, func(state *testLedger) int { return state.Balance })
+	assert.Equal(t, 15, balance)
+	assert.NoError(t, actor.Close(context.Background()))
+}
+
+func TestJournaledActorDiscardsPanickingEvent(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *JournaledActor[testLedger] {
+		actor := NewJournaledActor[testLedger](JournalConfig{Dir: dir, Fsync: true})
+		RegisterEvent(actor, "credited", func(state *testLedger, e testCredited) {
+			if e.Amount < 0 {
+				panic("negative")
+			}
+			state.Balance += e.Amount
+			state.Log = append(state.Log, "credit")
+		})
+		RegisterEvent(actor, "unencodable", func(state *testLedger, e testUnencodable) {
+			state.Balance = -100
+		})
+		assert.NoError(t, actor.Open(testLedger{}))
+		return actor
+	}
+	actor := open()
+	assert.NoError(t, actor.Persist(testCredited{Amount: 5}))
+	err := actor.Persist(testCredited{Amount: -1})
+	assert.IsType(t, &PanicError{}, err)
+	assert.Error(t, actor.Persist(testUnencodable{Ch: make(chan int)}))
+	state, _ := Read(actor, func(state *testLedger) testLedger { return *state })
+	assert.Equal(t, testLedger{Balance: 5, Log: []string{"credit"}}, state)
+	assert.NoError(t, actor.Persist(testCredited{Amount: 2}))
+	assert.NoError(t, actor.Snapshot())
+	assert.NoError(t, actor.Persist(testCredited{Amount: 3}))
+	assert.NoError(t, actor.Close(context.Background()))
+
+	actor = open()
+	state, _ = Read(actor, func(state *testLedger) testLedger { return *state })
+	assert.Equal(t, testLedger{Balance: 10, Log: []string{"credit", "credit", "credit"}}, state)
+	assert.NoError(t, actor.Close(context.Background()))
+
+	// A panic on replay, e.g. of a journal written by an older version, fails Open
+	f, _ := os.OpenFile(filepath.Join(dir, journalFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"seq":4,"type":"credited","data":{"amount":-1}}` + "\n")
+	f.Close()
+	actor = NewJournaledActor[testLedger](JournalConfig{Dir: dir})
+	RegisterEvent(actor, "credited", func(state *testLedger, e testCredited) {
+		if e.Amount < 0 {
+			panic("negative")
+		}
+	})
+	assert.Error(t, actor.Open(testLedger{}))
+}
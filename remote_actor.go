@@ -0,0 +1,279 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+const RemoteActorRouteId HttpRouteId = "remoteActorCommand"
+const RemoteActorPath = "/actors/:actor/:command"
+
+const (
+	HeaderCorrelationId = "X-Correlation-Id"
+	HeaderTimeoutMillis = "X-Timeout-Ms"
+	HeaderActorMode     = "X-Actor-Mode" // "tell" does not wait for the command, "ask" (default) returns its result
+)
+
+// ActorRef sends named commands to an actor, either local (RemoteActorServer.Ref) or
+// in another process (NewRemoteActorRef). Args and results must be JSON encodable.
+type ActorRef interface {
+	// Ask runs the command and decodes its result into result, which may be nil to ignore it
+	Ask(ctx context.Context, command string, args interface{}, result interface{}) error
+	// Tell enqueues the command without waiting for it
+	Tell(ctx context.Context, command string, args interface{}) error
+}
+
+// remoteCommand decodes args and runs the command on the actor, waiting for the result if wait is true
+type remoteCommand func(ctx context.Context, args []byte, wait bool) (interface{}, error)
+
+// RemoteActorServer exposes actors under names, with commands registered by RegisterRemoteCommand
+type RemoteActorServer struct {
+	mutex  sync.RWMutex
+	actors map[string]*remoteActor
+}
+
+type remoteActor struct {
+	actor    interface{}
+	commands map[string]remoteCommand
+}
+
+func NewRemoteActorServer() *RemoteActorServer {
+	return &RemoteActorServer{actors: map[string]*remoteActor{}}
+}
+
+// RegisterRemoteCommand exposes f as the command of the actor registered under actorName. An error returned
+// by f is sent to the client with the status of an HttpError, other errors are logged and sent as a bare 500.
+func RegisterRemoteCommand[S any, A any, R any](server *RemoteActorServer, actorName string, actor *Actor[S], command string, f func(state *S, args A) (R, error)) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	registered, ok := server.actors[actorName]
+	if !ok {
+		registered = &remoteActor{actor: actor, commands: map[string]remoteCommand{}}
+		server.actors[actorName] = registered
+	} else if registered.actor != interface{}(actor) {
+		panic(errors.New(fmt.Sprintf("Another actor is already registered as %s", actorName)))
+	}
+	registered.commands[command] = func(ctx context.Context, data []byte, wait bool) (interface{}, error) {
+		var args A
+		if err := json.Unmarshal(data, &args); err != nil {
+			return nil, &HttpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("Cannot decode args of %s.%s, reason %v", actorName, command, err)}
+		}
+		if !wait {
+			return nil, actor.TellCtx(context.WithoutCancel(ctx), func(state *S) {
+				if _, err := f(state, args); err != nil {
+					log.Errorf("Remote command %s.%s failed, reason %v", actorName, command, err)
+				}
+			})
+		}
+		type reply struct {
+			result R
+			err    error
+		}
+		result, err := AskCtx(ctx, actor, func(state *S) reply {
+			result, err := f(state, args)
+			return reply{result, err}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return result.result, result.err
+	}
+}
+
+func (this *RemoteActorServer) command(actorName string, command string) (remoteCommand, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	actor, ok := this.actors[actorName]
+	if !ok {
+		return nil, &HttpError{Code: http.StatusNotFound, Message: fmt.Sprintf("Actor %s not found", actorName)}
+	}
+	f, ok := actor.commands[command]
+	if !ok {
+		return nil, &HttpError{Code: http.StatusNotFound, Message: fmt.Sprintf("Command %s of actor %s not found", command, actorName)}
+	}
+	return f, nil
+}
+
+// DeclareRoutes declares RemoteActorRouteId on router, the JSON args are passed in the "args" form param
+func (this *RemoteActorServer) DeclareRoutes(router *HttpRouter) {
+	router.DeclareRoutePOST(RemoteActorRouteId, RemoteActorPath, this.handle,
+		HttpParam{Type: HttpParamType_URL, Name: "actor"},
+		HttpParam{Type: HttpParamType_URL, Name: "command"},
+		HttpParam{Type: HttpParamType_Form, Name: "args", DefaultValue: "null"})
+}
+
+func (this *RemoteActorServer) handle(routeId HttpRouteId, w http.ResponseWriter, r *http.Request, paramValues HttpParamValues) {
+	correlationId := r.Header.Get(HeaderCorrelationId)
+	if correlationId == "" {
+		correlationId = GenerateRandStr(16)
+	}
+	w.Header().Set(HeaderCorrelationId, correlationId)
+	w.Header().Set("Content-Type", "application/json")
+	ctx := WithRequestId(r.Context(), correlationId)
+	if timeout, err := strconv.ParseInt(r.Header.Get(HeaderTimeoutMillis), 10, 64); err == nil && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	wait := !strings.EqualFold(r.Header.Get(HeaderActorMode), "tell")
+
+	result, err := this.call(ctx, paramValues.GetString("actor"), paramValues.GetString("command"), []byte(paramValues.GetString("args")), wait)
+	if err != nil {
+		httpErr := toHttpError(err)
+		if httpErr.Code == http.StatusInternalServerError {
+			log.Errorf("Remote command %s failed, correlation id %s, reason %v", r.URL.Path, correlationId, err)
+		} else {
+			log.Debugf("Remote command %s failed, correlation id %s, reason %v", r.URL.Path, correlationId, err)
+		}
+		w.WriteHeader(httpErr.Code)
+		w.Write(httpErr.Response())
+		return
+	}
+	if !wait {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Write(JsonEncode(map[string]interface{}{"result": result}))
+}
+
+func (this *RemoteActorServer) call(ctx context.Context, actorName string, command string, args []byte, wait bool) (interface{}, error) {
+	f, err := this.command(actorName, command)
+	if err != nil {
+		return nil, err
+	}
+	return f(ctx, args, wait)
+}
+
+// httpStatusClientClosedRequest is the nginx status of a request which the client cancelled
+const httpStatusClientClosedRequest = 499
+
+// toHttpError maps errors of the actor and of the command to HTTP statuses. Details of unknown errors
+// are not sent to the client, the caller logs them.
+func toHttpError(err error) *HttpError {
+	if httpErr, ok := err.(*HttpError); ok {
+		return httpErr
+	}
+	var panicErr *PanicError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &HttpError{Code: http.StatusGatewayTimeout, Message: context.DeadlineExceeded.Error()}
+	case errors.Is(err, context.Canceled):
+		return &HttpError{Code: httpStatusClientClosedRequest, Message: context.Canceled.Error()}
+	case err == ErrStopped || err == ErrQueueFull || err == ErrDropped:
+		return &HttpError{Code: http.StatusServiceUnavailable, Message: err.Error()}
+	case errors.As(err, &panicErr):
+		return &HttpError{Code: http.StatusInternalServerError, Message: "Command panicked"}
+	}
+	return &HttpError{Code: http.StatusInternalServerError, Message: "Command failed"}
+}
+
+// Ref returns a reference to a local actor which behaves as a remote one, with the same JSON round trip of args
+func (this *RemoteActorServer) Ref(actorName string) ActorRef {
+	return &localActorRef{server: this, actorName: actorName}
+}
+
+type localActorRef struct {
+	server    *RemoteActorServer
+	actorName string
+}
+
+func (this *localActorRef) Ask(ctx context.Context, command string, args interface{}, result interface{}) error {
+	value, err := this.server.call(ctx, this.actorName, command, JsonEncode(args), true)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(JsonEncode(value), result)
+}
+
+func (this *localActorRef) Tell(ctx context.Context, command string, args interface{}) error {
+	_, err := this.server.call(ctx, this.actorName, command, JsonEncode(args), false)
+	return err
+}
+
+type remoteActorRef struct {
+	baseUrl   string
+	actorName string
+}
+
+// NewRemoteActorRef refers to the actor exposed as actorName by a RemoteActorServer at baseUrl, e.g. "http://host:8080".
+// Requests use HttpClient. The ctx deadline is sent to the server, errors sent by the server are returned as *HttpError.
+func NewRemoteActorRef(baseUrl string, actorName string) ActorRef {
+	return &remoteActorRef{baseUrl: strings.TrimRight(baseUrl, "/"), actorName: actorName}
+}
+
+func (this *remoteActorRef) Ask(ctx context.Context, command string, args interface{}, result interface{}) error {
+	body, err := this.post(ctx, command, args, "ask")
+	if err != nil || result == nil {
+		return err
+	}
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return err
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+func (this *remoteActorRef) Tell(ctx context.Context, command string, args interface{}) error {
+	_, err := this.post(ctx, command, args, "tell")
+	return err
+}
+
+func (this *remoteActorRef) post(ctx context.Context, command string, args interface{}, mode string) ([]byte, error) {
+	requestUrl := this.baseUrl + strings.NewReplacer(":actor", url.PathEscape(this.actorName), ":command", url.PathEscape(command)).Replace(RemoteActorPath)
+	data := url.Values{"args": {string(JsonEncode(args))}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", requestUrl, bytes.NewBufferString(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(HeaderActorMode, mode)
+	correlationId := RequestIdFromContext(ctx)
+	if correlationId == "" {
+		correlationId = GenerateRandStr(16)
+	}
+	req.Header.Set(HeaderCorrelationId, correlationId)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(HeaderTimeoutMillis, strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond)+1, 10))
+	}
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		httpErr := &HttpError{Code: resp.StatusCode}
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &errBody) == nil {
+			httpErr.Message = errBody.Message
+		} else {
+			httpErr.Message = string(body)
+		}
+		return nil, httpErr
+	}
+	return body, nil
+}
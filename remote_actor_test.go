@@ -0,0 +1,92 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRemoteAccount struct {
+	Balance int
+}
+
+type testRemoteDeposit struct {
+	Amount int `json:"amount"`
+}
+
+func startRemoteActorServer(server *RemoteActorServer) *httptest.Server {
+	router := NewHttpRouter()
+	server.DeclareRoutes(router)
+	return httptest.NewServer(router.Handler())
+}
+
+func TestRemoteActorAskAndTell(t *testing.T) {
+	// The bank process forwards deposits to the audit process
+	audit := NewActor([]string{}, 16)
+	defer audit.Destroy()
+	auditServer := NewRemoteActorServer()
+	RegisterRemoteCommand(auditServer, "audit", audit, "record", func(state *[]string, entry string) (int, error) {
+		*state = append(*state, entry+" "+RequestIdFromContext(audit.ActiveObject().Context()))
+		return len(*state), nil
+	})
+	auditHttp := startRemoteActorServer(auditServer)
+	defer auditHttp.Close()
+	auditRef := NewRemoteActorRef(auditHttp.URL, "audit")
+
+	account := NewActor(testRemoteAccount{}, 16)
+	defer account.Destroy()
+	bankServer := NewRemoteActorServer()
+	RegisterRemoteCommand(bankServer, "account", account, "deposit", func(state *testRemoteAccount, args testRemoteDeposit) (int, error) {
+		if args.Amount <= 0 {
+			return 0, &HttpError{Code: http.StatusConflict, Message: "Amount must be positive"}
+		}
+		state.Balance += args.Amount
+		err := auditRef.Tell(account.ActiveObject().Context(), "record", "deposit")
+		return state.Balance, err
+	})
+	RegisterRemoteCommand(bankServer, "account", account, "slow", func(state *testRemoteAccount, args struct{}) (bool, error) {
+		time.Sleep(200 * time.Millisecond)
+		return true, nil
+	})
+	bankHttp := startRemoteActorServer(bankServer)
+	defer bankHttp.Close()
+	bankRef := NewRemoteActorRef(bankHttp.URL, "account")
+
+	var balance int
+	ctx := WithRequestId(context.Background(), "req-1")
+	assert.NoError(t, bankRef.Ask(ctx, "deposit", testRemoteDeposit{Amount: 5}, &balance))
+	assert.Equal(t, 5, balance)
+	assert.NoError(t, bankServer.Ref("account").Ask(ctx, "deposit", testRemoteDeposit{Amount: 2}, &balance))
+	assert.Equal(t, 7, balance)
+
+	var count int
+	assert.NoError(t, auditRef.Ask(context.Background(), "record", "check", &count))
+	assert.Equal(t, 3, count)
+	entries, _ := Ask(audit, func(state *[]string) []string { return *state })
+	assert.Equal(t, []string{"deposit req-1", "deposit req-1"}, entries[:2])
+
+	err := bankRef.Ask(context.Background(), "deposit", testRemoteDeposit{Amount: -1}, nil)
+	assert.Equal(t, &HttpError{Code: http.StatusConflict, Message: "Amount must be positive"}, err)
+
+	err = bankRef.Ask(context.Background(), "withdraw", testRemoteDeposit{Amount: 1}, nil)
+	assert.Equal(t, http.StatusNotFound, err.(*HttpError).Code)
+
+	err = bankRef.Ask(context.Background(), "deposit", "not an object", nil)
+	assert.Equal(t, http.StatusBadRequest, err.(*HttpError).Code)
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, bankRef.Ask(timeoutCtx, "slow", struct{}{}, nil))
+}
+
+func TestToHttpErrorHidesUnknownErrors(t *testing.T) {
+	assert.Equal(t, &HttpError{Code: http.StatusInternalServerError, Message: "Command failed"}, toHttpError(errors.New("db password is wrong")))
+	assert.Equal(t, 499, toHttpError(context.Canceled).Code)
+	assert.Equal(t, http.StatusGatewayTimeout, toHttpError(fmt.Errorf("wait: %w", context.DeadlineExceeded)).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, toHttpError(ErrQueueFull).Code)
+}